@@ -7,4 +7,9 @@ require (
 	github.com/gorilla/mux v1.8.0
 	github.com/grafana/grafana-plugin-sdk-go v0.79.0
 	github.com/magefile/mage v1.12.1 // indirect
+	github.com/prometheus/client_golang v1.3.0
+	github.com/prometheus/client_model v0.1.0
+	go.opentelemetry.io/otel v0.16.0
+	go.opentelemetry.io/otel/exporters/otlp v0.16.0
+	go.opentelemetry.io/otel/sdk v0.16.0
 )
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+)
+
+// liveCaches are the response caches of the datasource instances that have not been disposed
+var liveCaches = map[*responseCache]bool{}
+var liveCachesMutex sync.Mutex
+
+func registerCache(cache *responseCache) {
+	liveCachesMutex.Lock()
+	defer liveCachesMutex.Unlock()
+	liveCaches[cache] = true
+}
+
+func unregisterCache(cache *responseCache) {
+	liveCachesMutex.Lock()
+	defer liveCachesMutex.Unlock()
+	delete(liveCaches, cache)
+}
+
+var (
+	cacheHitsDesc = prometheus.NewDesc(
+		"octopus_datasource_cache_hits_total",
+		"The number of Octopus requests served from the response cache.",
+		[]string{"datasource"}, nil)
+	cacheMissesDesc = prometheus.NewDesc(
+		"octopus_datasource_cache_misses_total",
+		"The number of Octopus requests not found in the response cache.",
+		[]string{"datasource"}, nil)
+	cacheKeysAddedDesc = prometheus.NewDesc(
+		"octopus_datasource_cache_keys_added_total",
+		"The number of responses added to the response cache.",
+		[]string{"datasource"}, nil)
+	cacheKeysEvictedDesc = prometheus.NewDesc(
+		"octopus_datasource_cache_keys_evicted_total",
+		"The number of responses evicted from the response cache to stay within the memory budget.",
+		[]string{"datasource"}, nil)
+	cacheBytesAddedDesc = prometheus.NewDesc(
+		"octopus_datasource_cache_bytes_added_total",
+		"The size of the responses added to the response cache.",
+		[]string{"datasource"}, nil)
+	cacheBytesEvictedDesc = prometheus.NewDesc(
+		"octopus_datasource_cache_bytes_evicted_total",
+		"The size of the responses evicted from the response cache.",
+		[]string{"datasource"}, nil)
+	cacheSetsRejectedDesc = prometheus.NewDesc(
+		"octopus_datasource_cache_sets_rejected_total",
+		"The number of responses the cache declined to hold, usually because they were larger than the memory budget allows.",
+		[]string{"datasource"}, nil)
+	cacheMaxBytesDesc = prometheus.NewDesc(
+		"octopus_datasource_cache_max_bytes",
+		"The memory budget of the response cache.",
+		[]string{"datasource"}, nil)
+)
+
+// cacheCollector reports the statistics kept by the response cache of each datasource instance
+type cacheCollector struct{}
+
+func (c cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheHitsDesc
+	ch <- cacheMissesDesc
+	ch <- cacheKeysAddedDesc
+	ch <- cacheKeysEvictedDesc
+	ch <- cacheBytesAddedDesc
+	ch <- cacheBytesEvictedDesc
+	ch <- cacheSetsRejectedDesc
+	ch <- cacheMaxBytesDesc
+}
+
+func (c cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	liveCachesMutex.Lock()
+	defer liveCachesMutex.Unlock()
+
+	for cache := range liveCaches {
+		metrics := cache.store.Metrics
+		if metrics == nil {
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(metrics.Hits()), cache.datasourceId)
+		ch <- prometheus.MustNewConstMetric(cacheMissesDesc, prometheus.CounterValue, float64(metrics.Misses()), cache.datasourceId)
+		ch <- prometheus.MustNewConstMetric(cacheKeysAddedDesc, prometheus.CounterValue, float64(metrics.KeysAdded()), cache.datasourceId)
+		ch <- prometheus.MustNewConstMetric(cacheKeysEvictedDesc, prometheus.CounterValue, float64(metrics.KeysEvicted()), cache.datasourceId)
+		ch <- prometheus.MustNewConstMetric(cacheBytesAddedDesc, prometheus.CounterValue, float64(metrics.CostAdded()), cache.datasourceId)
+		ch <- prometheus.MustNewConstMetric(cacheBytesEvictedDesc, prometheus.CounterValue, float64(metrics.CostEvicted()), cache.datasourceId)
+		ch <- prometheus.MustNewConstMetric(cacheSetsRejectedDesc, prometheus.CounterValue, float64(metrics.SetsRejected()), cache.datasourceId)
+		ch <- prometheus.MustNewConstMetric(cacheMaxBytesDesc, prometheus.GaugeValue, float64(cache.maxCost), cache.datasourceId)
+	}
+}
+
+func init() {
+	// The plugin SDK exposes the default registry through the Grafana plugin metrics endpoint
+	prometheus.MustRegister(cacheCollector{})
+}
@@ -5,25 +5,29 @@ import (
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"strconv"
 	"time"
 )
 
 func getBucketDuration(queryDuration time.Duration, bucketDuration time.Duration) (int64, time.Duration) {
 	buckets := Min(maxFrames, int64(queryDuration/bucketDuration))
+	if buckets < 1 {
+		// a bucket longer than the query holds the whole query
+		buckets = 1
+	}
 	return buckets, queryDuration / time.Duration(buckets)
 }
 
-func parseTimes(deployments Deployments) {
-	for i := 0; i < len(deployments.Deployments); i++ {
-		parsedTime, err := time.Parse(releaseHistoryDateFormat, deployments.Deployments[i].StartTime)
-		if err == nil {
-			deployments.Deployments[i].StartTimeParsed = parsedTime
-		}
+// parseDeploymentTimes parses the start and completed times returned by the reporting endpoint
+func parseDeploymentTimes(deployment *Deployment) {
+	parsedTime, err := time.Parse(releaseHistoryDateFormat, deployment.StartTime)
+	if err == nil {
+		deployment.StartTimeParsed = parsedTime
+	}
 
-		parsedTime, err = time.Parse(releaseHistoryDateFormat, deployments.Deployments[i].CompletedTime)
-		if err == nil {
-			deployments.Deployments[i].CompletedTimeParsed = parsedTime
-		}
+	parsedTime, err = time.Parse(releaseHistoryDateFormat, deployment.CompletedTime)
+	if err == nil {
+		deployment.CompletedTimeParsed = parsedTime
 	}
 }
 
@@ -38,14 +42,17 @@ func setCompletedTimeRounded(deployments Deployments, bucketDuration time.Durati
 
 // query generates a time series response, combining deployment information into time buckets
 // that can be displayed in a graph.
-func (td *SampleDatasource) query(ctx context.Context, qm queryModel, query backend.DataQuery, deployments Deployments, server string, space string, spaces map[string]string, apiKey string, cacheDuration string) backend.DataResponse {
-
-	log.DefaultLogger.Info("ReleaseVersion filter " + qm.ReleaseVersion)
-	log.DefaultLogger.Info("ProjectName filter " + qm.ProjectName)
-	log.DefaultLogger.Info("ChannelName filter " + qm.ChannelName)
-	log.DefaultLogger.Info("TenantName filter " + qm.TenantName)
-	log.DefaultLogger.Info("EnvironmentName filter " + qm.EnvironmentName)
-	log.DefaultLogger.Info("TaskState filter " + qm.TaskState)
+func (td *SampleDatasource) query(ctx context.Context, client OctopusClient, qm queryModel, query backend.DataQuery, deployments Deployments, space string, spaces map[string]string) backend.DataResponse {
+
+	log.DefaultLogger.Debug("Timeseries query filters",
+		"refId", query.RefID,
+		"space", qm.SpaceName,
+		"releaseVersion", qm.ReleaseVersion,
+		"projectName", qm.ProjectName,
+		"channelName", qm.ChannelName,
+		"tenantName", qm.TenantName,
+		"environmentName", qm.EnvironmentName,
+		"taskState", qm.TaskState)
 
 	response := backend.DataResponse{}
 
@@ -65,8 +72,16 @@ func (td *SampleDatasource) query(ctx context.Context, qm queryModel, query back
 	totalCycleTime := []uint32{}
 	avgCycleTime := []uint32{}
 
+	// The number of releases that could not be read, and the last error
+	releaseFailures := 0
+	var releaseError error
+
 	// Work out how long the buckets should be
-	buckets, bucketDuration := getBucketDuration(query.TimeRange.Duration(), time.Duration(int64(query.TimeRange.Duration())/query.MaxDataPoints))
+	interval := time.Duration(int64(query.TimeRange.Duration()) / query.MaxDataPoints)
+	if qm.BucketDuration > 0 {
+		interval = qm.BucketDuration
+	}
+	buckets, bucketDuration := getBucketDuration(query.TimeRange.Duration(), interval)
 
 	// get the bucket start time for each deployment
 	setCompletedTimeRounded(deployments, bucketDuration)
@@ -98,12 +113,16 @@ func (td *SampleDatasource) query(ctx context.Context, qm queryModel, query back
 						// get the cycle time, or the time from when the release was created.
 						// note we can only get this information if the release is still in the database, as the release creation
 						// date is not stored by the reporting endpoint
-						releaseDetails, err := getRelease(d.ReleaseId, server, spaces[space], apiKey)
+						releaseDetails, err := client.GetRelease(ctx, spaces[space], d.ReleaseId)
 
 						if err == nil {
 							diff := parseTime(d.CompletedTime).Sub(releaseDetails.AssembledDate).Seconds()
 							bucketCycleTime = append(bucketCycleTime, uint32(diff))
 							thisCycleTime = uint32(diff)
+						} else if !isNotFoundError(err) {
+							// a deleted release is expected, but any other failure means the lead time is missing data
+							releaseFailures++
+							releaseError = err
 						}
 					}
 
@@ -201,6 +220,10 @@ func (td *SampleDatasource) query(ctx context.Context, qm queryModel, query back
 		frame.Fields = append(frame.Fields, data.NewField("avgReleaseLeadTime", nil, avgCycleTime))
 	}
 
+	if releaseFailures != 0 {
+		frame.AppendNotices(newWarning("The release lead time excludes " + strconv.Itoa(releaseFailures) + " deployments whose release could not be read: " + describeError(releaseError)))
+	}
+
 	// add the frames to the response
 	response.Frames = append(response.Frames, frame)
 
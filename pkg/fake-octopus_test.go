@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the API key accepted by the fake Octopus server
+const fakeApiKey = "API-FAKE"
+
+// newFakeOctopusServer returns a server that answers the Octopus API requests made by the plugin with the
+// fixtures in the testdata directory. Only the Spaces-1 space has any projects, environments or deployments.
+func newFakeOctopusServer(t *testing.T) *httptest.Server {
+	fixture := func(name string) []byte {
+		body, err := ioutil.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Octopus-ApiKey") != fakeApiKey {
+			http.Error(rw, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+
+		path := req.URL.Path
+		switch {
+		case path == "/api":
+			rw.Write(fixture("api.json"))
+		case path == "/api/users/me":
+			rw.Write(fixture("user.json"))
+		case path == "/api/users/Users-1/permissions":
+			rw.Write(fixture("permissions.json"))
+		case path == "/api/spaces/all":
+			rw.Write(fixture("spaces.json"))
+		case path == "/api/Spaces-1/projects/all":
+			rw.Write(fixture("projects.json"))
+		case path == "/api/Spaces-1/environments/all":
+			rw.Write(fixture("environments.json"))
+		case path == "/api/Spaces-1/releases":
+			rw.Write(fixture("releases.json"))
+		case strings.HasPrefix(path, "/api/Spaces-1/releases/"):
+			rw.Write(fixture("release-" + strings.TrimPrefix(path, "/api/Spaces-1/releases/") + ".json"))
+		case path == "/api/Spaces-1/deployments":
+			rw.Write(fixture("deployments.json"))
+		case path == "/api/Spaces-1/reporting/deployments/xml":
+			rw.Write(filterReportingFixture(t, fixture("reporting.xml"), req))
+		case strings.HasPrefix(path, "/api/Spaces-2/") && strings.HasSuffix(path, "/all"):
+			rw.Write([]byte("[]"))
+		case path == "/api/Spaces-2/reporting/deployments/xml":
+			rw.Write([]byte("<Deployments></Deployments>"))
+		default:
+			http.NotFound(rw, req)
+		}
+	}))
+}
+
+// filterReportingFixture applies the filters supported by the reporting endpoint to the reporting fixture
+func filterReportingFixture(t *testing.T, fixture []byte, req *http.Request) []byte {
+	deployments := Deployments{}
+	err := xml.Unmarshal(fixture, &deployments)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := req.URL.Query()
+	from, _ := time.Parse(octopusDateFormat, query.Get("fromCompletedTime"))
+	to, _ := time.Parse(octopusDateFormat, query.Get("toCompletedTime"))
+
+	filtered := Deployments{}
+	for _, deployment := range deployments.Deployments {
+		completed, _ := time.Parse(releaseHistoryDateFormat, deployment.CompletedTime)
+		if completed.Before(from) || !completed.Before(to) {
+			continue
+		}
+
+		if !empty(query.Get("projectId")) && deployment.ProjectId != query.Get("projectId") {
+			continue
+		}
+
+		if !empty(query.Get("environmentId")) && deployment.EnvironmentId != query.Get("environmentId") {
+			continue
+		}
+
+		filtered.Deployments = append(filtered.Deployments, deployment)
+	}
+
+	body, err := xml.Marshal(filtered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// newFakePluginContext returns the context of an admin using a datasource connected to server with apiKey
+func newFakePluginContext(server string, apiKey string) backend.PluginContext {
+	jsonData, _ := json.Marshal(datasourceModel{Server: server})
+
+	return backend.PluginContext{
+		User: &backend.User{Login: "admin", Role: adminRole},
+		DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+			ID:                      1,
+			JSONData:                jsonData,
+			DecryptedSecureJSONData: map[string]string{"apiKey": apiKey},
+		},
+	}
+}
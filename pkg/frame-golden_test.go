@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The golden files lock down the frames returned to Grafana, as the field names are used in dashboards.
+// Run "go test -update" to rewrite them after an intended change, and review the differences.
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata/golden")
+
+// frameSnapshot is the JSON representation of a frame stored in a golden file
+type frameSnapshot struct {
+	Name   string          `json:"name"`
+	Fields []fieldSnapshot `json:"fields"`
+}
+
+type fieldSnapshot struct {
+	Name   string        `json:"name"`
+	Type   string        `json:"type"`
+	Values []interface{} `json:"values"`
+}
+
+func getFrameSnapshots(frames []*data.Frame) []frameSnapshot {
+	snapshots := []frameSnapshot{}
+	for _, frame := range frames {
+		snapshot := frameSnapshot{Name: frame.Name, Fields: []fieldSnapshot{}}
+		for _, field := range frame.Fields {
+			values := []interface{}{}
+			for i := 0; i < field.Len(); i++ {
+				values = append(values, field.At(i))
+			}
+			snapshot.Fields = append(snapshot.Fields, fieldSnapshot{Name: field.Name, Type: field.Type().ItemTypeString(), Values: values})
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots
+}
+
+// assertGolden compares the frames to the golden file with the name, or rewrites the file if the update flag is set
+func assertGolden(t *testing.T, name string, response backend.DataResponse) {
+	t.Helper()
+
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+
+	actual, err := json.MarshalIndent(getFrameSnapshots(response.Frames), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual = append(actual, '\n')
+
+	path := filepath.Join("testdata", "golden", name+".json")
+
+	if *updateGolden {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(path, actual, 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read the golden file, run \"go test -update\" to create it: %s", err)
+	}
+
+	if !bytes.Equal(actual, expected) {
+		t.Fatalf("the frames do not match %s, run \"go test -update\" if the change is intended.\nexpected:\n%s\nactual:\n%s", path, expected, actual)
+	}
+}
+
+// getGoldenDeployments returns the deployments in the reporting fixture
+func getGoldenDeployments(t *testing.T) Deployments {
+	file, err := os.Open(filepath.Join("testdata", "reporting.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	deployments := Deployments{}
+	_, err = decodeDeployments(file, nil, func(deployment Deployment) {
+		deployments.Deployments = append(deployments.Deployments, deployment)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deployments
+}
+
+func TestTableGolden(t *testing.T) {
+	tests := []struct {
+		name  string
+		query queryModel
+	}{
+		{"table", queryModel{}},
+		{"table-project", queryModel{ProjectName: "Web"}},
+		{"table-failed", queryModel{TaskState: "Failed"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			td := &SampleDatasource{}
+			assertGolden(t, test.name, td.queryTable(context.Background(), test.query, getGoldenDeployments(t)))
+		})
+	}
+}
+
+func TestTimeseriesGolden(t *testing.T) {
+	client := &fakeOctopusClient{
+		releases: map[string]Release{
+			"Releases-1": {Id: "Releases-1", AssembledDate: time.Date(2021, 1, 1, 9, 0, 0, 0, time.UTC)},
+			"Releases-2": {Id: "Releases-2", AssembledDate: time.Date(2021, 1, 1, 9, 30, 0, 0, time.UTC)},
+		},
+	}
+
+	allFields := queryModel{
+		SuccessField:               true,
+		FailureField:               true,
+		CancelledField:             true,
+		TimedOutField:              true,
+		TotalDurationField:         true,
+		AverageDurationField:       true,
+		TotalTimeToRecoveryField:   true,
+		AverageTimeToRecoveryField: true,
+		TotalCycleTimeField:        true,
+		AverageCycleTimeField:      true,
+	}
+	webFields := allFields
+	webFields.ProjectName = "Web"
+
+	tests := []struct {
+		name  string
+		query queryModel
+	}{
+		{"timeseries", allFields},
+		{"timeseries-project", webFields},
+		{"timeseries-no-fields", queryModel{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := backend.DataQuery{MaxDataPoints: 12}
+			query.TimeRange.From = time.Date(2021, 1, 1, 6, 0, 0, 0, time.UTC)
+			query.TimeRange.To = time.Date(2021, 1, 1, 18, 0, 0, 0, time.UTC)
+
+			td := &SampleDatasource{}
+			spaces := map[string]string{"Default": "Spaces-1"}
+			assertGolden(t, test.name, td.query(context.Background(), client, test.query, query, getGoldenDeployments(t), "Default", spaces))
+		})
+	}
+}
+
+func TestResourcesGolden(t *testing.T) {
+	td := &SampleDatasource{}
+	response, err := td.queryResources(map[string]string{"Test": "Environments-1", "Production": "Environments-2", "Development": "Environments-3"}, "environments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertGolden(t, "resources", response)
+}
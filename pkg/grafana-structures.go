@@ -1,6 +1,10 @@
 package main
 
-import "github.com/grafana/grafana-plugin-sdk-go/backend"
+import (
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"time"
+)
 
 type queryModel struct {
 	SpaceName                  string `json:"spaceName"`
@@ -21,12 +25,43 @@ type queryModel struct {
 	AverageTimeToRecoveryField bool   `json:"averageTimeToRecoveryField"`
 	TotalCycleTimeField        bool   `json:"totalCycleTimeField"`
 	AverageCycleTimeField      bool   `json:"averageCycleTimeField"`
-	OctopusQueryUrl            string
-	Query                      backend.DataQuery
+	// BucketInterval is the duration of each timeseries bucket, like "1h" or "$__interval". The buckets are sized
+	// to fit the maximum number of data points when it is empty.
+	BucketInterval string `json:"bucketInterval"`
+	// BucketDuration is the parsed BucketInterval
+	BucketDuration  time.Duration `json:"-"`
+	OctopusQueryUrl string
+	Query           backend.DataQuery
+	// Error is returned in place of the frame when the query can not be completed
+	Error error `json:"-"`
+	// Notices are displayed with the frame when only some of the data used by the query could be retrieved
+	Notices []data.Notice `json:"-"`
+	// Filters are the parsed ProjectName, EnvironmentName, TenantName, ChannelName, ReleaseVersion and TaskState filters
+	Filters *deploymentFilters `json:"-"`
 }
 
 type datasourceModel struct {
 	Server        string
 	Format        string
 	CacheDuration string
+	// CacheSize is the memory used to cache Octopus responses, in megabytes. The reporting deployments are not
+	// counted, and are bounded by maxReportingDeployments instead.
+	CacheSize int `json:"cacheSize"`
+	// PersistentCache enables saving the reporting deployments to disk, so they survive plugin restarts
+	PersistentCache bool `json:"persistentCache"`
+	// PersistentCacheDirectory is where the reporting deployments are saved, defaulting to the data directory in the plugin directory
+	PersistentCacheDirectory string `json:"persistentCacheDirectory"`
+	// Timeout is the duration to wait for a response from Octopus, like "100s"
+	Timeout           string `json:"timeout"`
+	TlsSkipVerify     bool   `json:"tlsSkipVerify"`
+	TlsAuth           bool   `json:"tlsAuth"`
+	TlsAuthWithCACert bool   `json:"tlsAuthWithCACert"`
+	// Concurrency is the number of requests the datasource can be waiting on Octopus for at once, across all of its queries
+	Concurrency int `json:"concurrency"`
+	// RateLimit is the number of requests per second sent to Octopus, with no limit if it is 0
+	RateLimit float64 `json:"rateLimit"`
+	// RateLimitBurst is the number of requests that can be sent at once before the rate limit applies
+	RateLimitBurst int `json:"rateLimitBurst"`
+	// LogResponseBodies logs the start of each Octopus response at the debug level, with any secrets redacted
+	LogResponseBodies bool `json:"logResponseBodies"`
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// requiredPermissions are the permissions the API key needs in each space Grafana reports on
+var requiredPermissions = []string{"DeploymentView", "EnvironmentView", "ProcessView", "ProjectView", "ReleaseView", "TenantView"}
+
+// spaceHealth is the access the API key has to a space
+type spaceHealth struct {
+	MissingPermissions []string `json:"missingPermissions,omitempty"`
+	ReportingError     string   `json:"reportingError,omitempty"`
+}
+
+// healthDetails are returned with the health check result, for anyone wanting more than the message
+type healthDetails struct {
+	Version string `json:"version"`
+	User    string `json:"user,omitempty"`
+	// PermissionsError is set if the permissions of the user could not be read, in which case no
+	// space lists its missing permissions
+	PermissionsError string                 `json:"permissionsError,omitempty"`
+	Spaces           map[string]spaceHealth `json:"spaces"`
+}
+
+// getMissingPermissions returns the required permissions that have not been granted in the space
+func getMissingPermissions(permissions UserPermissions, spaceId string) []string {
+	missing := []string{}
+	for _, permission := range requiredPermissions {
+		granted := false
+		for _, restriction := range permissions.SpacePermissions[permission] {
+			if empty(restriction.SpaceId) || restriction.SpaceId == spaceId {
+				granted = true
+				break
+			}
+		}
+
+		if !granted {
+			missing = append(missing, permission)
+		}
+	}
+	return missing
+}
+
+// checkHealth checks the server can be reached, then reads the permissions of the API key and tests access
+// to the reporting endpoint of every space it can see. The result lists any missing access per space.
+func checkHealth(ctx context.Context, client OctopusClient, concurrency int) *backend.CheckHealthResult {
+	root, err := client.GetApiRoot(ctx)
+	if err != nil {
+		return &backend.CheckHealthResult{
+			Status:  backend.HealthStatusError,
+			Message: "Failed to contact Octopus server, or API key is invalid: " + describeError(err),
+		}
+	}
+
+	spaces, err := client.GetResources(ctx, "spaces", "")
+	if err != nil {
+		return &backend.CheckHealthResult{
+			Status:  backend.HealthStatusError,
+			Message: "Connected to Octopus " + root.Version + ", but failed to get the spaces: " + describeError(err),
+		}
+	}
+
+	details := healthDetails{Version: root.Version, Spaces: map[string]spaceHealth{}}
+
+	// servers that predate spaces have no space permissions, so only the reporting endpoint is checked
+	capabilities := newServerCapabilities(root.Version)
+	if !capabilities.supports(spacesCapability) {
+		spaces = map[string]string{"": ""}
+	}
+
+	var permissions UserPermissions
+	user, err := client.GetCurrentUser(ctx)
+	if err == nil {
+		details.User = user.Username
+		err = capabilities.require(spacesCapability)
+	}
+	if err == nil {
+		permissions, err = client.GetUserPermissions(ctx, user.Id)
+	}
+	if err != nil {
+		details.PermissionsError = describeError(err)
+	}
+
+	// the reporting endpoint of each space is tested concurrently, as there may be many spaces
+	var detailsMutex sync.Mutex
+	pool := newWorkerPool(concurrency)
+	for spaceName, spaceId := range spaces {
+		spaceName := spaceName
+		spaceId := spaceId
+		pool.Go(func() {
+			health := spaceHealth{}
+			if empty(details.PermissionsError) {
+				health.MissingPermissions = getMissingPermissions(permissions, spaceId)
+			}
+			if err := client.CheckReportingAccess(ctx, spaceId); err != nil {
+				health.ReportingError = describeError(err)
+			}
+
+			detailsMutex.Lock()
+			defer detailsMutex.Unlock()
+			details.Spaces[spaceName] = health
+		})
+	}
+	pool.Wait()
+
+	result := &backend.CheckHealthResult{Status: backend.HealthStatusOk}
+	result.JSONDetails, _ = json.Marshal(details)
+
+	connected := "Connected to Octopus " + root.Version
+	if !empty(details.User) {
+		connected += " as " + details.User
+	}
+
+	// the problems are listed in a stable order, so the message doesn't change between checks
+	spaceNames := []string{}
+	for spaceName := range details.Spaces {
+		spaceNames = append(spaceNames, spaceName)
+	}
+	sort.Strings(spaceNames)
+
+	problems := []string{}
+	for _, spaceName := range spaceNames {
+		health := details.Spaces[spaceName]
+		if len(health.MissingPermissions) != 0 {
+			problems = append(problems, describeSpace(spaceName)+" is missing "+strings.Join(health.MissingPermissions, ", "))
+		}
+		if !empty(health.ReportingError) {
+			problems = append(problems, describeSpace(spaceName)+" can not read the reporting endpoint: "+health.ReportingError)
+		}
+	}
+
+	if len(problems) != 0 {
+		result.Status = backend.HealthStatusError
+		result.Message = connected + ", but " + strings.Join(problems, "; ")
+		return result
+	}
+
+	result.Message = connected + ". The reporting endpoint can be read in " + strconv.Itoa(len(spaces)) + " spaces"
+	if !empty(details.PermissionsError) {
+		result.Message += ", but the permissions were not checked: " + details.PermissionsError
+	} else {
+		result.Message += ", which have all the required permissions"
+	}
+	return result
+}
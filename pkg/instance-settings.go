@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// the timeout applied to Octopus requests when the datasource does not define one
+const defaultTimeout = time.Second * 100
+
+type instanceSettings struct {
+	// identifies the datasource and its credentials, and prefixes any cached data
+	scope string
+	// makes the requests to Octopus for this instance
+	client     OctopusClient
+	httpClient *http.Client
+	// the responses returned by Octopus to this instance
+	cache *responseCache
+	// the deployments returned by the reporting endpoint, which are saved to disk if the persistent cache is enabled
+	reportingStore *reportingStore
+	// the number of Octopus requests the datasource makes at once, which the transport of httpClient enforces
+	concurrency int
+}
+
+func newDataSourceInstance(setting backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
+	var jsonData datasourceModel
+	if len(setting.JSONData) != 0 {
+		err := json.Unmarshal(setting.JSONData, &jsonData)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	httpClient, err := newHttpClient(jsonData, setting)
+	if err != nil {
+		return nil, err
+	}
+
+	// An instance without a cache still works, it just makes more requests to Octopus
+	scope := getCacheScope(setting)
+	cache, err := newResponseCache(setting.ID, scope, jsonData.CacheSize)
+	if err != nil {
+		log.DefaultLogger.Error("Caching was not enabled because " + err.Error() + ".")
+	}
+
+	storePath := ""
+	if jsonData.PersistentCache {
+		storePath, err = getReportingStorePath(jsonData.PersistentCacheDirectory, setting.ID, jsonData.Server, setting.DecryptedSecureJSONData["apiKey"])
+		if err != nil {
+			return nil, err
+		}
+		removeStaleReportingStores(storePath, setting.ID)
+	}
+
+	concurrency := getConcurrency(jsonData)
+	store := openReportingStore(storePath)
+	apiKey := setting.DecryptedSecureJSONData["apiKey"]
+
+	return &instanceSettings{
+		scope:          scope,
+		client:         newOctopusClient(strconv.FormatInt(setting.ID, 10), jsonData.Server, apiKey, jsonData.LogResponseBodies, jsonData.CacheDuration, httpClient, cache, store, concurrency),
+		httpClient:     httpClient,
+		cache:          cache,
+		reportingStore: store,
+		concurrency:    concurrency,
+	}, nil
+}
+
+func (s *instanceSettings) Dispose() {
+	// Called before creating a new instance to allow plugin authors
+	// to cleanup. The cached responses were fetched with the old settings, so they are discarded.
+	s.cache.close()
+	s.reportingStore.close()
+	s.httpClient.CloseIdleConnections()
+}
+
+// newHttpClient builds the client used for every Octopus request made by a datasource instance. The TLS
+// and header settings follow the same jsonData and secureJsonData names as Grafana's built in datasources.
+// The client also enforces the rate limit and the maximum number of requests in flight, and records the
+// metrics of the requests that are sent.
+func newHttpClient(jsonData datasourceModel, setting backend.DataSourceInstanceSettings) (*http.Client, error) {
+	timeout := defaultTimeout
+	if !empty(jsonData.Timeout) {
+		parsedTimeout, err := time.ParseDuration(jsonData.Timeout)
+		if err != nil {
+			return nil, errors.New("Could not parse timeout: " + jsonData.Timeout)
+		}
+		timeout = parsedTimeout
+	}
+
+	tlsConfig, err := getTlsConfig(jsonData, setting.DecryptedSecureJSONData)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cloning the default transport retains the proxy settings from the environment
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: newLimitTransport(jsonData.RateLimit, jsonData.RateLimitBurst, getConcurrency(jsonData), &metricsTransport{
+			datasource: strconv.FormatInt(setting.ID, 10),
+			base: &headerTransport{
+				headers: getCustomHeaders(setting.JSONData, setting.DecryptedSecureJSONData),
+				base:    transport,
+			},
+		}),
+	}, nil
+}
+
+// getConcurrency returns the number of requests the datasource can be waiting on Octopus for at once
+func getConcurrency(jsonData datasourceModel) int {
+	if jsonData.Concurrency > 0 {
+		return jsonData.Concurrency
+	}
+
+	return defaultConcurrency
+}
+
+// getTlsConfig returns the TLS settings for the certificates defined in the datasource
+func getTlsConfig(jsonData datasourceModel, secureJsonData map[string]string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: jsonData.TlsSkipVerify,
+	}
+
+	if jsonData.TlsAuthWithCACert && !empty(secureJsonData["tlsCACert"]) {
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM([]byte(secureJsonData["tlsCACert"])) {
+			return nil, errors.New("Failed to parse the TLS CA certificate")
+		}
+		tlsConfig.RootCAs = caPool
+	}
+
+	if jsonData.TlsAuth {
+		cert, err := tls.X509KeyPair([]byte(secureJsonData["tlsClientCert"]), []byte(secureJsonData["tlsClientKey"]))
+		if err != nil {
+			return nil, errors.New("Failed to parse the TLS client certificate or key: " + err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// getCustomHeaders returns the headers defined as pairs of httpHeaderNameX in the jsonData, and httpHeaderValueX
+// in the secureJsonData, where X is a number starting at 1
+func getCustomHeaders(rawJsonData json.RawMessage, secureJsonData map[string]string) map[string]string {
+	headers := map[string]string{}
+
+	var jsonData map[string]interface{}
+	if json.Unmarshal(rawJsonData, &jsonData) != nil {
+		return headers
+	}
+
+	for index := 1; ; index++ {
+		name, ok := jsonData["httpHeaderName"+strconv.Itoa(index)].(string)
+		if !ok {
+			break
+		}
+
+		if !empty(name) {
+			headers[name] = secureJsonData["httpHeaderValue"+strconv.Itoa(index)]
+		}
+	}
+
+	return headers
+}
+
+// headerTransport adds the custom headers to each request
+type headerTransport struct {
+	headers map[string]string
+	base    http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(t.headers) == 0 {
+		return t.base.RoundTrip(req)
+	}
+
+	// A RoundTripper must not modify the request it was given
+	req = req.Clone(req.Context())
+	for name, value := range t.headers {
+		req.Header.Set(name, value)
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+func (t *headerTransport) CloseIdleConnections() {
+	if closer, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
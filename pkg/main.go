@@ -8,10 +8,18 @@ import (
 )
 
 func main() {
+	// Export the spans of each request if an OTLP collector has been configured
+	shutdownTracing, err := initTracing()
+	if err != nil {
+		log.DefaultLogger.Error("Failed to start tracing: " + err.Error())
+		shutdownTracing = func() {}
+	}
+
 	// Start listening to requests send from Grafana. This call is blocking so
 	// it wont finish until Grafana shutsdown the process or the plugin choose
 	// to exit close down by itself
-	err := datasource.Serve(newDatasource())
+	err = datasource.Serve(newDatasource())
+	shutdownTracing()
 
 	// Log any error if we could start the plugin.
 	if err != nil {
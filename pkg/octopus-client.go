@@ -0,0 +1,605 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"go.opentelemetry.io/otel/label"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OctopusClient makes the requests to the Octopus REST API for a datasource instance. Each method
+// returns the parsed results of an endpoint, so the query code can be tested against a fake client.
+type OctopusClient interface {
+	// GetApiRoot returns the root of the API, which confirms the server can be reached with the API key
+	GetApiRoot(ctx context.Context) (ApiRoot, error)
+	// GetCapabilities returns what the server supports, based on the version it reports from /api
+	GetCapabilities(ctx context.Context) (serverCapabilities, error)
+	// GetSpaces returns a map of space names to ids. The default space is also mapped from " ".
+	GetSpaces(ctx context.Context) (map[string]string, error)
+	// GetResources returns a map of the names, or versions, of the resources of a type to their ids.
+	// Resources that are not space scoped ignore the space.
+	GetResources(ctx context.Context, resourceType string, spaceId string) (map[string]string, error)
+	// GetDeployments returns the deployments created between earliestDate and latestDate. A zero date
+	// leaves that end of the range open. skip and take page through the deployments, newest first.
+	GetDeployments(ctx context.Context, spaceId string, projectId string, environmentId string, skip int, take int, earliestDate time.Time, latestDate time.Time) ([]PlainDeployment, error)
+	// GetRelease returns the details of a specific release
+	GetRelease(ctx context.Context, spaceId string, releaseId string) (Release, error)
+	// GetReportingDeployments returns the deployments from the reporting endpoint that completed between
+	// earliestDate and latestDate, leaving out those the filter does not include
+	GetReportingDeployments(ctx context.Context, spaceId string, environmentId string, projectId string, filter reportingFilter, earliestDate time.Time, latestDate time.Time) (*Deployments, error)
+	// GetCurrentUser returns the user that owns the API key
+	GetCurrentUser(ctx context.Context) (User, error)
+	// GetUserPermissions returns the permissions granted to the user
+	GetUserPermissions(ctx context.Context, userId string) (UserPermissions, error)
+	// CheckReportingAccess returns an error if the reporting endpoint of the space can not be read
+	CheckReportingAccess(ctx context.Context, spaceId string) error
+}
+
+// octopusClient is the OctopusClient used by a datasource instance
+type octopusClient struct {
+	// the id of the datasource, which labels the metrics and log entries
+	datasourceId string
+	server       string
+	apiKey       string
+	// logResponseBodies enables logging the start of each response body at the debug level
+	logResponseBodies bool
+	// how long responses for entities like projects and environments are cached. An empty duration disables caching.
+	cacheDuration  string
+	httpClient     *http.Client
+	cache          *responseCache
+	reportingStore *reportingStore
+	// the number of requests the client runs at once, which are also limited by the transport of the http client
+	concurrency int
+	// coalesces concurrent requests for the same url
+	requests *requestGroup
+	// capabilities are read from the server the first time they are needed
+	capabilities      *serverCapabilities
+	capabilitiesMutex sync.Mutex
+}
+
+func newOctopusClient(datasourceId string, server string, apiKey string, logResponseBodies bool, cacheDuration string, httpClient *http.Client, cache *responseCache, reportingStore *reportingStore, concurrency int) *octopusClient {
+	return &octopusClient{
+		datasourceId:      datasourceId,
+		logResponseBodies: logResponseBodies,
+		server:            server,
+		apiKey:            apiKey,
+		cacheDuration:     cacheDuration,
+		httpClient:        httpClient,
+		cache:             cache,
+		reportingStore:    reportingStore,
+		concurrency:       concurrency,
+		requests:          newRequestGroup(),
+	}
+}
+
+func (c *octopusClient) GetApiRoot(ctx context.Context) (ApiRoot, error) {
+	body, err := c.createRequest(ctx, c.server+"/api", c.cacheDuration)
+	if err != nil {
+		return ApiRoot{}, err
+	}
+
+	var root ApiRoot
+	err = json.Unmarshal(body, &root)
+	return root, err
+}
+
+// GetCapabilities reads the server version once, and keeps the capabilities for the life of the client. A failure
+// to read the version is not kept, so it is read again by the next request. Callers that need the version at the
+// same time share one request, through the request group of createRequest, and each waits on its own context.
+func (c *octopusClient) GetCapabilities(ctx context.Context) (serverCapabilities, error) {
+	c.capabilitiesMutex.Lock()
+	capabilities := c.capabilities
+	c.capabilitiesMutex.Unlock()
+
+	if capabilities != nil {
+		return *capabilities, nil
+	}
+
+	root, err := c.GetApiRoot(ctx)
+	if err != nil {
+		return serverCapabilities{}, err
+	}
+
+	read := newServerCapabilities(root.Version)
+	c.capabilitiesMutex.Lock()
+	c.capabilities = &read
+	c.capabilitiesMutex.Unlock()
+	return read, nil
+}
+
+// GetSpaces returns no spaces for servers that predate them, so every request is made without a space
+func (c *octopusClient) GetSpaces(ctx context.Context) (map[string]string, error) {
+	capabilities, err := c.GetCapabilities(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !capabilities.supports(spacesCapability) {
+		return map[string]string{}, nil
+	}
+
+	url := getResourceUrl("spaces", c.server, "")
+
+	body, err := c.createRequest(ctx, url, c.cacheDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsedResults []SpaceResource
+	err = json.Unmarshal(body, &parsedResults)
+
+	if err == nil {
+		results := make(map[string]string)
+		for _, r := range parsedResults {
+			results[r.Name] = r.Id
+			// the default space is the unnamed space, identified as a single space
+			if r.IsDefault {
+				results[" "] = r.Id
+			}
+		}
+		return results, nil
+	}
+
+	return nil, err
+}
+
+// GetResources returns no spaces for servers that predate them, and reads the paged collection of servers
+// without the /all endpoints
+func (c *octopusClient) GetResources(ctx context.Context, resourceType string, spaceId string) (map[string]string, error) {
+	capabilities, err := c.GetCapabilities(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if resourceType == "spaces" && !capabilities.supports(spacesCapability) {
+		return map[string]string{}, nil
+	}
+	if err := capabilities.requireResource(resourceType); err != nil {
+		return nil, err
+	}
+
+	url := getResourceUrl(resourceType, c.server, spaceId)
+
+	var parsedResults []BaseResource
+
+	if pagedResources[resourceType] {
+		parsedResults, err = c.getPagedBaseResources(ctx, url)
+	} else if !capabilities.supports(allRoutesCapability) {
+		parsedResults, err = c.getPagedBaseResources(ctx, strings.TrimSuffix(url, "/all"))
+	} else {
+		var body []byte
+		body, err = c.createRequest(ctx, url, c.cacheDuration)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal(body, &parsedResults)
+	}
+
+	if err == nil {
+		results := make(map[string]string)
+		for _, r := range parsedResults {
+			if !empty(r.Version) {
+				results[r.Version] = r.Id
+			} else {
+				results[r.Name] = r.Id
+			}
+		}
+		return results, nil
+	}
+
+	return nil, err
+}
+
+func (c *octopusClient) GetDeployments(ctx context.Context, spaceId string, projectId string, environmentId string, skip int, take int, earliestDate time.Time, latestDate time.Time) ([]PlainDeployment, error) {
+	deploymentsUrl := getResourceUrl("deployments", c.server, spaceId) +
+		"?projects=" + url.QueryEscape(projectId) +
+		"&environments=" + url.QueryEscape(environmentId)
+
+	items, err := c.getPagedResources(ctx, deploymentsUrl, skip, take, earliestDate, latestDate, plainDeploymentCreated)
+	if err != nil {
+		return []PlainDeployment{}, err
+	}
+
+	deployments := []PlainDeployment{}
+	for _, item := range items {
+		var deployment PlainDeployment
+		err = json.Unmarshal(item, &deployment)
+		if err != nil {
+			return []PlainDeployment{}, err
+		}
+
+		time, err := time.Parse(dateFormat, deployment.Created)
+		if err == nil {
+			deployment.CreatedParsed = time
+		} else {
+			log.DefaultLogger.Error("Failed to parse date " + deployment.Created)
+		}
+
+		deployments = append(deployments, deployment)
+	}
+
+	return deployments, nil
+}
+
+// GetRelease returns an error for releases without an Assembled date, as they can't be used to calculate the lead time
+func (c *octopusClient) GetRelease(ctx context.Context, spaceId string, releaseId string) (Release, error) {
+	capabilities, err := c.GetCapabilities(ctx)
+	if err != nil {
+		return Release{}, err
+	}
+	if err := capabilities.require(releaseAssembledCapability); err != nil {
+		return Release{}, err
+	}
+
+	var url string
+
+	if !empty(spaceId) {
+		url = c.server + "/api/" + spaceId + "/releases/" + releaseId
+	} else {
+		url = c.server + "/api/releases/" + releaseId
+	}
+
+	body, err := c.createRequest(ctx, url, longCache)
+	if err != nil {
+		return Release{}, err
+	}
+
+	var parsedResults Release
+	err = json.Unmarshal(body, &parsedResults)
+
+	if err != nil {
+		return Release{}, err
+	}
+
+	assembled, err := time.Parse(dateFormat, parsedResults.Assembled)
+	if err != nil {
+		return Release{}, errors.New("The release " + releaseId + " has no valid Assembled date: " + parsedResults.Assembled)
+	}
+	parsedResults.AssembledDate = assembled
+	return parsedResults, nil
+}
+
+// GetReportingDeployments widens the range to whole reportingWindows, and only the parts of those windows that are not
+// already held in the reporting store are requested from Octopus, one window per request. The windows are requested
+// concurrently. The deployments are read as they are received, and those the filter does not include are never stored.
+func (c *octopusClient) GetReportingDeployments(ctx context.Context, spaceId string, environmentId string, projectId string, filter reportingFilter, earliestDate time.Time, latestDate time.Time) (*Deployments, error) {
+	capabilities, err := c.GetCapabilities(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := capabilities.require(reportingCapability); err != nil {
+		return nil, err
+	}
+
+	if err := validateReportingRange(earliestDate, latestDate); err != nil {
+		return nil, err
+	}
+
+	filterKey := filter.key()
+	windowsFrom := earliestDate.UTC().Truncate(reportingWindow)
+	windowsTo := latestDate.UTC().Truncate(reportingWindow).Add(reportingWindow)
+
+	missing := []timeRange{}
+	for _, missingRange := range c.reportingStore.missingRanges(spaceId, projectId, environmentId, filterKey, windowsFrom, windowsTo) {
+		missing = append(missing, splitTimeRange(missingRange, reportingWindow)...)
+	}
+
+	if len(missing) == 0 {
+		reportingCacheRequests.WithLabelValues(c.datasourceId, "hit").Inc()
+	} else {
+		reportingCacheRequests.WithLabelValues(c.datasourceId, "miss").Inc()
+	}
+
+	// the windows are requested concurrently, but the requests still wait on the in-flight limit of the transport
+	pool := newWorkerPool(c.concurrency)
+	var resultsMutex sync.Mutex
+	var firstErr error
+	fetched := []timeRange{}
+	deployments := []Deployment{}
+
+	for _, window := range missing {
+		window := window
+		pool.Go(func() {
+			url := buildReportingQueryUrl(c.server, spaceId, environmentId, projectId, window.From, window.To)
+			// concurrent queries for the same window and filters share the one response
+			value, err, _ := c.requests.do(ctx, "reporting "+filterKey+" "+url, func(ctx context.Context) (interface{}, error) {
+				windowDeployments := []Deployment{}
+				err := c.createStreamingRequest(ctx, url, func(body io.Reader) error {
+					// a retry reads the response from the start
+					windowDeployments = []Deployment{}
+					parsed, err := decodeDeployments(body, filter, func(deployment Deployment) {
+						windowDeployments = append(windowDeployments, deployment)
+					})
+					reportingRecordsParsed.WithLabelValues(c.datasourceId, "kept").Add(float64(len(windowDeployments)))
+					reportingRecordsParsed.WithLabelValues(c.datasourceId, "discarded").Add(float64(parsed - len(windowDeployments)))
+					return err
+				})
+				return windowDeployments, err
+			})
+
+			resultsMutex.Lock()
+			defer resultsMutex.Unlock()
+
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+
+			fetched = append(fetched, window)
+			deployments = append(deployments, value.([]Deployment)...)
+		})
+	}
+
+	pool.Wait()
+
+	// the windows that were read are stored even if another window failed, so they are not requested again
+	if len(fetched) != 0 {
+		c.reportingStore.add(spaceId, projectId, environmentId, filterKey, fetched, deployments)
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return &Deployments{Deployments: c.reportingStore.deployments(spaceId, projectId, environmentId, earliestDate, latestDate)}, nil
+}
+
+// validateReportingRange returns an error if the range is reversed, or spans more than maxReportingWindows
+func validateReportingRange(earliestDate time.Time, latestDate time.Time) error {
+	if latestDate.Before(earliestDate) {
+		return errors.New("The reporting range ends at " + latestDate.Format(octopusDateFormat) + ", before it starts at " + earliestDate.Format(octopusDateFormat))
+	}
+
+	windows := latestDate.UTC().Truncate(reportingWindow).Sub(earliestDate.UTC().Truncate(reportingWindow))/reportingWindow + 1
+	if windows > maxReportingWindows {
+		return errors.New("The reporting range from " + earliestDate.Format(octopusDateFormat) + " to " + latestDate.Format(octopusDateFormat) +
+			" spans " + strconv.Itoa(int(windows)) + " weeks, more than the limit of " + strconv.Itoa(maxReportingWindows))
+	}
+
+	return nil
+}
+
+// GetCurrentUser is never cached, as it is used to check the API key
+func (c *octopusClient) GetCurrentUser(ctx context.Context) (User, error) {
+	body, err := c.createRequest(ctx, c.server+"/api/users/me", "")
+	if err != nil {
+		return User{}, err
+	}
+
+	var user User
+	err = json.Unmarshal(body, &user)
+	return user, err
+}
+
+// GetUserPermissions is never cached, so changes to the permissions are seen by the next health check
+func (c *octopusClient) GetUserPermissions(ctx context.Context, userId string) (UserPermissions, error) {
+	body, err := c.createRequest(ctx, c.server+"/api/users/"+url.PathEscape(userId)+"/permissions", "")
+	if err != nil {
+		return UserPermissions{}, err
+	}
+
+	var permissions UserPermissions
+	err = json.Unmarshal(body, &permissions)
+	return permissions, err
+}
+
+// CheckReportingAccess requests the deployments completed in the last minute, which is enough to check the
+// permissions without returning much data. The response is neither cached nor added to the reporting store.
+func (c *octopusClient) CheckReportingAccess(ctx context.Context, spaceId string) error {
+	latestDate := time.Now().UTC()
+	_, err := c.createRequest(ctx, buildReportingQueryUrl(c.server, spaceId, "", "", latestDate.Add(-time.Minute), latestDate), "")
+	return err
+}
+
+// createRequest returns the response from Octopus, or from the response cache
+func (c *octopusClient) createRequest(ctx context.Context, url string, cacheDuration string) (body []byte, err error) {
+	log.DefaultLogger.Debug("GET request to Octopus", c.getRequestLogFields(url)...)
+
+	ctx, span := startSpan(ctx, "createRequest", label.String("http.url", redactSecrets(url)))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	// load the cached result
+	value, found := c.cache.get(url)
+	span.SetAttributes(label.Bool("cache.hit", found))
+	if found {
+		log.DefaultLogger.Debug("Cache hit", c.getRequestLogFields(url)...)
+
+		if cause, ok := value.(error); ok {
+			err := &circuitBreakerError{url: url, cause: cause}
+			log.DefaultLogger.Error("Request blocked by the circuit breaker", c.getRequestLogFields(url, "status", getErrorStatus(cause), "error", redactSecrets(cause.Error()))...)
+			return nil, err
+		}
+
+		return value.([]byte), nil
+	}
+
+	// concurrent requests for the same url share the one response
+	value, err, shared := c.requests.do(ctx, url, func(ctx context.Context) (interface{}, error) {
+		return c.fetchResponse(ctx, url, cacheDuration)
+	})
+	span.SetAttributes(label.Bool("request.shared", shared))
+	if shared {
+		log.DefaultLogger.Debug("Shared the response to the GET request in flight", c.getRequestLogFields(url)...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return value.([]byte), nil
+}
+
+// fetchResponse requests the url from Octopus, and caches the response
+func (c *octopusClient) fetchResponse(ctx context.Context, url string, cacheDuration string) ([]byte, error) {
+	start := time.Now()
+
+	// transient failures are retried, so only failures that persist trip the circuit breaker
+	body, err := defaultRetryPolicy.sendRequest(ctx, c.httpClient, url, c.apiKey)
+	if err != nil {
+		// a cancelled request says nothing about the health of the server, so don't trip the circuit breaker
+		if !empty(cacheDuration) && ctx.Err() == nil {
+			c.cache.set(url, err, failedDuration)
+		}
+
+		log.DefaultLogger.Error("GET request to Octopus failed", c.getRequestLogFields(url, "status", getErrorStatus(err), "duration", time.Since(start).String(), "error", redactSecrets(err.Error()))...)
+		return nil, err
+	}
+
+	log.DefaultLogger.Debug("GET request to Octopus completed", c.getRequestLogFields(url, "status", "200", "duration", time.Since(start).String(), "bytes", len(body))...)
+	// the bodies can hold personal details and variable values, so they are only logged when the datasource asks for it
+	if c.logResponseBodies {
+		log.DefaultLogger.Debug("GET request to Octopus responded with", c.getRequestLogFields(url, "body", formatLoggedBody(body))...)
+	}
+
+	// cache the result
+	if !empty(cacheDuration) {
+		duration, durationError := time.ParseDuration(cacheDuration)
+		if durationError == nil {
+			c.cache.set(url, body, duration)
+		} else {
+			log.DefaultLogger.Error("Could not parse duration: "+cacheDuration+". Caching is disabled.", "instance", c.datasourceId)
+		}
+	}
+
+	return body, nil
+}
+
+// createStreamingRequest makes a request to Octopus, passing the response to read as it is received. The response
+// is never held by the response cache, but a failed request trips the circuit breaker in the same way as createRequest.
+func (c *octopusClient) createStreamingRequest(ctx context.Context, url string, read responseReader) (err error) {
+	log.DefaultLogger.Debug("Streaming GET request to Octopus", c.getRequestLogFields(url)...)
+	start := time.Now()
+
+	ctx, span := startSpan(ctx, "createStreamingRequest", label.String("http.url", redactSecrets(url)))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	value, found := c.cache.get(url)
+	if cause, ok := value.(error); found && ok {
+		err := &circuitBreakerError{url: url, cause: cause}
+		log.DefaultLogger.Error("Request blocked by the circuit breaker", c.getRequestLogFields(url, "status", getErrorStatus(cause), "error", redactSecrets(cause.Error()))...)
+		return err
+	}
+
+	err = defaultRetryPolicy.streamRequest(ctx, c.httpClient, url, c.apiKey, read)
+	if err != nil {
+		if ctx.Err() == nil {
+			c.cache.set(url, err, failedDuration)
+		}
+
+		log.DefaultLogger.Error("Streaming GET request to Octopus failed", c.getRequestLogFields(url, "status", getErrorStatus(err), "duration", time.Since(start).String(), "error", redactSecrets(err.Error()))...)
+		return err
+	}
+
+	// the reporting responses are read as they are received, so they are never logged
+	log.DefaultLogger.Debug("Streaming GET request to Octopus completed", c.getRequestLogFields(url, "status", "200", "duration", time.Since(start).String())...)
+	return nil
+}
+
+// getPagedResources reads the items from an Octopus collection endpoint, following the Page.Next links
+// until take items have been read or the last page is reached. A take of 0 reads every page.
+// Octopus returns collections newest first, so if earliestDate is set the reader also stops at the first
+// item (as reported by itemTime) that is older than earliestDate. If latestDate is set, the items newer
+// than latestDate are passed over, and skip and take only count the items that are not.
+func (c *octopusClient) getPagedResources(ctx context.Context, collectionUrl string, skip int, take int, earliestDate time.Time, latestDate time.Time, itemTime pagedItemTime) ([]json.RawMessage, error) {
+	filterLatest := itemTime != nil && !latestDate.IsZero()
+
+	pageSize := defaultPageSize
+	if take > 0 && !filterLatest {
+		pageSize = MinInt(take, defaultPageSize)
+	}
+
+	// Octopus can only skip items before the newer ones are filtered out, so those are skipped as they are read
+	serverSkip := skip
+	if filterLatest {
+		serverSkip = 0
+	}
+
+	pageUrl, err := setPagingParams(collectionUrl, serverSkip, pageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []json.RawMessage{}
+	offset := serverSkip
+	skipped := 0
+	visited := map[string]bool{}
+
+	for !empty(pageUrl) && !visited[pageUrl] {
+		visited[pageUrl] = true
+
+		body, err := c.createRequest(ctx, pageUrl, c.cacheDuration)
+		if err != nil {
+			return nil, err
+		}
+
+		var page PagedCollection
+		err = json.Unmarshal(body, &page)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range page.Items {
+			if itemTime != nil && (!earliestDate.IsZero() || filterLatest) {
+				created, err := itemTime(item)
+				if err == nil && !earliestDate.IsZero() && created.Before(earliestDate) {
+					return results, nil
+				}
+				if err == nil && filterLatest && created.After(latestDate) {
+					continue
+				}
+			}
+
+			if filterLatest && skipped < skip {
+				skipped++
+				continue
+			}
+
+			results = append(results, item)
+
+			if take > 0 && len(results) >= take {
+				return results, nil
+			}
+		}
+
+		offset += len(page.Items)
+		if len(page.Items) == 0 || offset >= page.TotalResults {
+			break
+		}
+
+		pageUrl = resolveLink(c.server, page.Links["Page.Next"])
+	}
+
+	return results, nil
+}
+
+// getPagedBaseResources reads every page of a collection endpoint into a list of BaseResources
+func (c *octopusClient) getPagedBaseResources(ctx context.Context, url string) ([]BaseResource, error) {
+	items, err := c.getPagedResources(ctx, url, 0, 0, time.Time{}, time.Time{}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []BaseResource{}
+	for _, item := range items {
+		var resource BaseResource
+		err = json.Unmarshal(item, &resource)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, resource)
+	}
+
+	return results, nil
+}
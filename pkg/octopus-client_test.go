@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newPagedDeploymentServer serves total deployments from /api/Spaces-1/deployments, newest first,
+// one created each hour before start.
+func newPagedDeploymentServer(total int, start time.Time) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		skip, _ := strconv.Atoi(req.URL.Query().Get("skip"))
+		take, _ := strconv.Atoi(req.URL.Query().Get("take"))
+
+		page := PagedCollection{
+			ItemType:     "Deployment",
+			TotalResults: total,
+			ItemsPerPage: take,
+			Links:        map[string]string{},
+		}
+
+		for i := skip; i < MinInt(skip+take, total); i++ {
+			item, _ := json.Marshal(PlainDeployment{
+				Id:      "Deployments-" + strconv.Itoa(i),
+				Name:    "Deploy " + strconv.Itoa(i),
+				Created: start.Add(-time.Duration(i) * time.Hour).Format(dateFormat),
+			})
+			page.Items = append(page.Items, item)
+		}
+
+		if skip+take < total {
+			page.Links["Page.Next"] = req.URL.Path + "?skip=" + strconv.Itoa(skip+take) + "&take=" + strconv.Itoa(take)
+		}
+
+		body, _ := json.Marshal(page)
+		rw.Write(body)
+	}))
+}
+
+// newTestClient returns the client of a new datasource instance connected to server
+func newTestClient(t *testing.T, server string, apiKey string) *octopusClient {
+	jsonData, _ := json.Marshal(datasourceModel{Server: server})
+	instance, err := newDataSourceInstance(backend.DataSourceInstanceSettings{
+		ID:                      1,
+		JSONData:                jsonData,
+		DecryptedSecureJSONData: map[string]string{"apiKey": apiKey},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return instance.(*instanceSettings).client.(*octopusClient)
+}
+
+func TestGetDeploymentsFollowsPages(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	server := newPagedDeploymentServer(250, start)
+	defer server.Close()
+
+	deployments, err := newTestClient(t, server.URL, "").GetDeployments(context.Background(), "Spaces-1", "", "", 0, 0, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deployments) != 250 {
+		t.Fatalf("expected 250 deployments, got %d", len(deployments))
+	}
+
+	if !deployments[249].CreatedParsed.Equal(start.Add(-249 * time.Hour)) {
+		t.Fatalf("unexpected created date %s", deployments[249].CreatedParsed)
+	}
+}
+
+func TestGetDeploymentsSkipTake(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	server := newPagedDeploymentServer(250, start)
+	defer server.Close()
+
+	deployments, err := newTestClient(t, server.URL, "").GetDeployments(context.Background(), "Spaces-1", "", "", 95, 10, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deployments) != 10 || deployments[0].Id != "Deployments-95" || deployments[9].Id != "Deployments-104" {
+		t.Fatalf("unexpected deployments %v", deployments)
+	}
+}
+
+func TestGetDeploymentsTimeBound(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	server := newPagedDeploymentServer(1000, start)
+	defer server.Close()
+
+	deployments, err := newTestClient(t, server.URL, "").GetDeployments(context.Background(), "Spaces-1", "", "", 0, 0, start.Add(-150*time.Hour), start.Add(-10*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deployments) != 141 || deployments[0].Id != "Deployments-10" || deployments[140].Id != "Deployments-150" {
+		t.Fatalf("expected deployments 10 to 150, got %d", len(deployments))
+	}
+}
+
+func TestGetDeploymentsTakeAfterTimeBound(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	server := newPagedDeploymentServer(250, start)
+	defer server.Close()
+
+	tests := []struct {
+		name          string
+		skip          int
+		expectedFirst string
+		expectedLast  string
+	}{
+		{"take", 0, "Deployments-20", "Deployments-29"},
+		{"skip and take", 5, "Deployments-25", "Deployments-34"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// the 20 deployments newer than the range do not count towards skip or take
+			deployments, err := newTestClient(t, server.URL, "").GetDeployments(context.Background(), "Spaces-1", "", "", test.skip, 10, time.Time{}, start.Add(-20*time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(deployments) != 10 || deployments[0].Id != test.expectedFirst || deployments[9].Id != test.expectedLast {
+				t.Fatalf("expected deployments %s to %s, got %v", test.expectedFirst, test.expectedLast, deployments)
+			}
+		})
+	}
+}
+
+func TestCacheIsScopedToCredentials(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		rw.Write([]byte(req.Header.Get("X-Octopus-ApiKey")))
+	}))
+	defer server.Close()
+
+	for _, apiKey := range []string{"API-ADMIN", "API-READER"} {
+		client := newTestClient(t, server.URL, apiKey)
+
+		body, err := client.createRequest(context.Background(), server.URL+"/api", "1h")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// wait for the cache to process the new item
+		time.Sleep(10 * time.Millisecond)
+
+		requestsBefore := requests
+		cached, _ := client.createRequest(context.Background(), server.URL+"/api", "1h")
+		if string(body) != apiKey || string(cached) != apiKey || requests != requestsBefore {
+			t.Fatalf("expected the cached response for %s, got %s and %s", apiKey, body, cached)
+		}
+	}
+
+	if newTestClient(t, server.URL, "API-ADMIN").cache.scope == newTestClient(t, server.URL, "API-READER").cache.scope {
+		t.Fatal("expected the cache scope to depend on the API key")
+	}
+
+	client := newTestClient(t, server.URL, "API-ADMIN")
+	client.createRequest(context.Background(), server.URL+"/api", "1h")
+	time.Sleep(10 * time.Millisecond)
+
+	client.cache.close()
+	if _, found := client.cache.get(server.URL + "/api"); found {
+		t.Fatal("expected the cache to be cleared when it is closed")
+	}
+}
+
+func TestGetReportingDeploymentsOnlyFetchesGaps(t *testing.T) {
+	var requestedMutex sync.Mutex
+	requested := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api" {
+			w.Write([]byte(`{"Version": "2020.1.0"}`))
+			return
+		}
+
+		requestedMutex.Lock()
+		defer requestedMutex.Unlock()
+		requested = append(requested, r.URL.Query().Get("fromCompletedTime")+" "+r.URL.Query().Get("toCompletedTime"))
+		w.Write([]byte("<Deployments></Deployments>"))
+	}))
+	defer server.Close()
+
+	client := newTestClient(t, server.URL, "API-TEST")
+	// a Wednesday, so the first request is widened to the weeks starting on Monday 2021-01-04 and 2021-01-11
+	start := time.Date(2021, 1, 6, 0, 0, 0, 0, time.UTC)
+	monday := time.Date(2021, 1, 4, 0, 0, 0, 0, time.UTC)
+	week := func(weeks int) string {
+		return monday.Add(time.Duration(weeks) * reportingWindow).Format(octopusDateFormat)
+	}
+
+	tests := []struct {
+		name     string
+		from     time.Duration
+		to       time.Duration
+		expected []string
+	}{
+		{"first range", 0, 7 * 24 * time.Hour, []string{week(0) + " " + week(1), week(1) + " " + week(2)}},
+		{"cached range", 24 * time.Hour, 48 * time.Hour, []string{}},
+		{"later range", 7 * 24 * time.Hour, 14 * 24 * time.Hour, []string{week(2) + " " + week(3)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requested = []string{}
+			_, err := client.GetReportingDeployments(context.Background(), "Spaces-1", "", "Projects-1", nil,
+				start.Add(test.from), start.Add(test.to))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sort.Strings(requested)
+			if !reflect.DeepEqual(requested, test.expected) {
+				t.Fatalf("expected requests for %v, got %v", test.expected, requested)
+			}
+		})
+	}
+}
+
+func TestConcurrentQueriesShareTheInFlightLimit(t *testing.T) {
+	var running, maxRunning int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if current <= max || atomic.CompareAndSwapInt32(&maxRunning, max, current) {
+				break
+			}
+		}
+
+		if r.URL.Path == "/api" {
+			w.Write([]byte(`{"Version": "2020.1.0"}`))
+			return
+		}
+
+		time.Sleep(5 * time.Millisecond)
+		w.Write([]byte("<Deployments></Deployments>"))
+	}))
+	defer server.Close()
+
+	client := newTestClient(t, server.URL, "API-TEST")
+	start := time.Date(2021, 1, 4, 0, 0, 0, 0, time.UTC)
+
+	// each query requests eight windows, for a different project so the requests are not shared
+	var wait sync.WaitGroup
+	for _, projectId := range []string{"Projects-1", "Projects-2", "Projects-3"} {
+		projectId := projectId
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			_, err := client.GetReportingDeployments(context.Background(), "Spaces-1", "", projectId, nil, start, start.Add(8*reportingWindow-time.Hour))
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wait.Wait()
+
+	if maxRunning > defaultConcurrency {
+		t.Fatalf("expected at most %d requests at once, got %d", defaultConcurrency, maxRunning)
+	}
+}
+
+func TestGetReportingDeploymentsRejectsInvalidRanges(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api" {
+			w.Write([]byte(`{"Version": "2020.1.0"}`))
+			return
+		}
+
+		t.Errorf("expected no reporting requests, got %s", r.URL)
+	}))
+	defer server.Close()
+
+	start := time.Date(2021, 1, 6, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		from time.Time
+		to   time.Time
+	}{
+		{"reversed", start, start.Add(-time.Hour)},
+		{"too many windows", start.AddDate(-20, 0, 0), start},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := newTestClient(t, server.URL, "API-TEST").GetReportingDeployments(context.Background(), "Spaces-1", "", "", nil, test.from, test.to)
+			if err == nil {
+				t.Fatal("expected the range to be rejected")
+			}
+		})
+	}
+}
@@ -3,13 +3,20 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"encoding/xml"
+	"errors"
 	"github.com/gorilla/mux"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/datasource"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/label"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const octopusDateFormat = "2006-01-02 15:04:05"
@@ -34,6 +41,9 @@ func newDatasource() datasource.ServeOpts {
 	router.HandleFunc("/Spaces-{[0-9]+}/deployments", ds.handleDeploymentResources)
 	// The deployments reporting endpoint
 	router.HandleFunc("/Spaces-{[0-9]+}/reporting/deployments", ds.handleReportingRequest)
+	// Cache statistics and purging, for Grafana admins
+	router.HandleFunc("/cache", ds.handleCacheStats).Methods(http.MethodGet)
+	router.HandleFunc("/cache/purge", ds.handleCachePurge).Methods(http.MethodPost)
 
 	return datasource.ServeOpts{
 		QueryDataHandler:    ds,
@@ -59,101 +69,250 @@ func getConnectionDetails(context backend.PluginContext) (string, string, string
 	return jsonData.Server, apiKey, jsonData.CacheDuration
 }
 
+// getInstance returns the settings for the datasource instance making the request
+func (td *SampleDatasource) getInstance(pluginContext backend.PluginContext) (*instanceSettings, error) {
+	instance, err := td.im.Get(pluginContext)
+	if err != nil {
+		return nil, err
+	}
+	return instance.(*instanceSettings), nil
+}
+
 // QueryData handles multiple queries and returns multiple responses.
 // req contains the queries []DataQuery (where each query contains RefID as a unique identifer).
 // The QueryDataResponse contains a map of RefID to the response for each query, and each response
-// contains Frames ([]*Frame).
+// contains Frames ([]*Frame). A query that fails reports its own error, so the other queries still
+// return their frames.
 func (td *SampleDatasource) QueryData(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
-	server, apiKey, cacheDuration := getConnectionDetails(req.PluginContext)
+	instance, err := td.getInstance(req.PluginContext)
+	if err != nil {
+		return nil, err
+	}
+
+	datasourceId := strconv.FormatInt(req.PluginContext.DataSourceInstanceSettings.ID, 10)
+	defer observeQueryDataDuration(datasourceId, req, time.Now())
+
+	// the spans join the trace of the Grafana request
+	ctx, span := startSpan(extractTraceContext(ctx, req.Headers), "QueryData",
+		label.String("datasource", datasourceId),
+		label.Int("queries", len(req.Queries)))
+	defer span.End()
 
 	// get a mapping of space names to ids
-	spaces, err := getAllResources("spaces", server, "", apiKey, cacheDuration)
+	spaces, err := instance.client.GetResources(ctx, "spaces", "")
 	if err != nil {
-		return nil, err
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		// no query can be run without the spaces, so they all report the error
+		response := backend.NewQueryDataResponse()
+		for _, query := range req.Queries {
+			response.Responses[query.RefID] = backend.DataResponse{Error: newQueryError("Failed to get the spaces", err)}
+		}
+		return response, nil
 	}
 
 	// Get an array of parsed queries, with links back to the original backend query request, and maps of entities and data
 	// from the Octopus REST API
-	queries, data, generalEntityData, err := prepareQueries(req, server, apiKey, cacheDuration, spaces)
-	if err != nil {
-		return nil, err
+	queries, data, generalEntityData := prepareQueries(ctx, instance.client, instance.concurrency, req, spaces)
+
+	// There is no point building a response if Grafana has abandoned the query
+	if ctx.Err() != nil {
+		span.SetStatus(codes.Error, ctx.Err().Error())
+		return nil, ctx.Err()
 	}
 
 	// Use the cache of data we returned with the call to prepareQueries() to build the grafana response
-	response := td.processQueries(ctx, queries, server, apiKey, cacheDuration, spaces, data, generalEntityData)
+	response := td.processQueries(ctx, instance.client, datasourceId, queries, spaces, data, generalEntityData)
 
 	return response, nil
 }
 
 // processQueries converts the data returned from the Octopus REST APIs to data to be returned to grafana
-func (td *SampleDatasource) processQueries(ctx context.Context, queries []*queryModel, server string, apiKey string, cacheDuration string, spaces map[string]string, data map[string]*Deployments, generalEntityData map[string]map[string]string) (response *backend.QueryDataResponse) {
+func (td *SampleDatasource) processQueries(ctx context.Context, client OctopusClient, datasourceId string, queries []*queryModel, spaces map[string]string, data map[string]*Deployments, generalEntityData map[string]map[string]string) (response *backend.QueryDataResponse) {
 	// create response struct
 	response = backend.NewQueryDataResponse()
 
 	// We now have a list of queries, the URLs we would use to get the data, and a map of those URLs to the results
 	// of the API requests. So we can no go ahead and build the response.
 	for _, q := range queries {
+		if q.Error != nil {
+			response.Responses[q.Query.RefID] = backend.DataResponse{Error: q.Error}
+			continue
+		}
 
+		start := time.Now()
+		frameCtx, span := startSpan(ctx, "buildFrame",
+			label.String("refId", q.Query.RefID),
+			label.String("format", q.Format))
+
+		var queryResponse backend.DataResponse
 		if q.Format == "table" {
-			response.Responses[q.Query.RefID] = td.queryTable(ctx, *q, *data[q.OctopusQueryUrl])
+			queryResponse = td.queryTable(frameCtx, *q, *data[q.OctopusQueryUrl])
 		} else if q.Format == "timeseries" {
-			response.Responses[q.Query.RefID] = td.query(ctx, *q, q.Query, *data[q.OctopusQueryUrl], server, q.SpaceName, spaces, apiKey, cacheDuration)
+			queryResponse = td.query(frameCtx, client, *q, q.Query, *data[q.OctopusQueryUrl], q.SpaceName, spaces)
 		} else {
 			// Any other format is the name of a resource that has an "all" endpoint in Octopus, which we retrieve as a table
-			response.Responses[q.Query.RefID], _ = td.queryResources(generalEntityData[q.OctopusQueryUrl], q.Format)
+			var err error
+			queryResponse, err = td.queryResources(generalEntityData[q.OctopusQueryUrl], q.Format)
+			if err != nil {
+				queryResponse = backend.DataResponse{Error: err}
+			}
+		}
+
+		queryFrameDuration.WithLabelValues(datasourceId, q.Format).Observe(time.Since(start).Seconds())
+		endSpan(span, queryResponse.Error)
+
+		for _, frame := range queryResponse.Frames {
+			frame.AppendNotices(q.Notices...)
 		}
+
+		response.Responses[q.Query.RefID] = queryResponse
 	}
 
 	return response
 }
 
-// getSpaces returns a map of space names to ids
-func getSpaces(server string, apiKey string, cacheDuration string) (spaces map[string]string, err error) {
-	// get a mapping of space names to ids
-	spaces, err = getAllResources("spaces", server, "", apiKey, cacheDuration)
-	if err != nil {
-		return nil, err
+// observeQueryDataDuration records the time taken to answer each query in a request. The queries share the
+// requests made to Octopus, so each query is recorded with the duration of the whole request.
+func observeQueryDataDuration(datasourceId string, req *backend.QueryDataRequest, start time.Time) {
+	duration := time.Since(start).Seconds()
+	for _, query := range req.Queries {
+		qm, _ := getQueryModel(query)
+		queryDataDuration.WithLabelValues(datasourceId, qm.Format).Observe(duration)
+	}
+}
+
+// getSpaceId returns the id of the named space. An empty name is the default space, which has an empty id.
+func getSpaceId(spaces map[string]string, spaceName string) (string, error) {
+	if empty(spaceName) {
+		return "", nil
+	}
+
+	if spaceId, ok := spaces[spaceName]; ok {
+		return spaceId, nil
+	}
+
+	return "", errors.New("space '" + spaceName + "' not found")
+}
+
+// describeSpace returns the name of the space used in messages
+func describeSpace(spaceName string) string {
+	if empty(spaceName) {
+		return "the default space"
 	}
-	return spaces, nil
+	return "space '" + spaceName + "'"
+}
+
+// getMapKey returns the key of the errors returned by getMaps
+func getMapKey(spaceName string, resourceType string) string {
+	return spaceName + "/" + resourceType
 }
 
-// getMaps returns maps of space names to project names to ids, and maps of space name to environment names to ids
-func getMaps(req *backend.QueryDataRequest, server string, apiKey string, cacheDuration string, spaces map[string]string) (projectsMap map[string]map[string]string, environmentsMap map[string]map[string]string, err error) {
+// getMaps returns maps of space names to project names to ids, and maps of space name to environment names to ids.
+// The errors from looking up the projects or environments of a space are returned by the key from getMapKey.
+func getMaps(ctx context.Context, client OctopusClient, pool *workerPool, req *backend.QueryDataRequest, spaces map[string]string) (projectsMap map[string]map[string]string, environmentsMap map[string]map[string]string, mapErrors map[string]error) {
+	ctx, span := startSpan(ctx, "getMaps")
+	defer span.End()
+
 	projectsMap = make(map[string]map[string]string)
 	environmentsMap = make(map[string]map[string]string)
+	mapErrors = make(map[string]error)
+	// The maps are populated by the worker pool, so the writes are synchronised
+	var mapsMutex sync.Mutex
+	// The spaces that have been passed to the worker pool
+	requestedSpaces := map[string]bool{}
 
 	// get the projects and environments for the queried spaces
 	for i := 0; i < len(req.Queries); i++ {
-		qm, _ := getQueryModel(req.Queries[i].JSON)
+		qm, _ := getQueryModel(req.Queries[i])
+		spaceName := qm.SpaceName
 
-		if _, ok := projectsMap[qm.SpaceName]; !ok {
-			projects, _ := getAllResources("projects", server, spaces[qm.SpaceName], apiKey, cacheDuration)
-			projectsMap[qm.SpaceName] = projects
+		if requestedSpaces[spaceName] {
+			continue
 		}
+		requestedSpaces[spaceName] = true
 
-		if _, ok := environmentsMap[qm.SpaceName]; !ok {
-			environments, _ := getAllResources("environments", server, spaces[qm.SpaceName], apiKey, cacheDuration)
-			environmentsMap[qm.SpaceName] = environments
+		// the queries for a space that does not exist report the error themselves
+		spaceId, err := getSpaceId(spaces, spaceName)
+		if err != nil {
+			continue
 		}
+
+		pool.Go(func() {
+			projects, err := client.GetResources(ctx, "projects", spaceId)
+			mapsMutex.Lock()
+			defer mapsMutex.Unlock()
+			projectsMap[spaceName] = projects
+			if err != nil {
+				mapErrors[getMapKey(spaceName, "projects")] = err
+			}
+		})
+
+		pool.Go(func() {
+			environments, err := client.GetResources(ctx, "environments", spaceId)
+			mapsMutex.Lock()
+			defer mapsMutex.Unlock()
+			environmentsMap[spaceName] = environments
+			if err != nil {
+				mapErrors[getMapKey(spaceName, "environments")] = err
+			}
+		})
 	}
 
-	return projectsMap, environmentsMap, nil
+	pool.Wait()
+
+	return projectsMap, environmentsMap, mapErrors
 }
 
-// prepareQueries looks through the queries, groups Octopus API calls to improve performance and remove redundant API calls, and returns the raw Octopus data
-func prepareQueries(req *backend.QueryDataRequest, server string, apiKey string, cacheDuration string, spaces map[string]string) (queries []*queryModel, data map[string]*Deployments, generalEntityData map[string]map[string]string, err error) {
-	earliestDate, latestDate := getQueryDetails(req)
+// getEntityId returns the id of the project or environment matched by a filter, which is used to filter the deployments
+// requested from Octopus. Filters matching anything other than a single name have no id, and the deployments are
+// filtered by name instead. If the id of a single name is not known, an empty id is returned and a notice is added to
+// the query, as the deployments can still be filtered by name.
+func getEntityId(qm *queryModel, entityType string, filter valueFilter, ids map[string]string, err error) string {
+	name, exact := filter.exactValue()
+	if !exact {
+		// the names in a list that match nothing are most likely typos, so they are reported in the same way
+		missing := []string{}
+		for _, name := range filter.listedValues() {
+			if _, ok := ids[name]; !ok && err == nil {
+				missing = append(missing, "'"+name+"'")
+			}
+		}
 
-	spaces, err = getSpaces(server, apiKey, cacheDuration)
-	if err != nil {
-		return nil, nil, nil, err
+		if len(missing) > 0 {
+			sort.Strings(missing)
+			qm.Notices = append(qm.Notices, newWarning(entityType+"s "+strings.Join(missing, ", ")+" not found in "+describeSpace(qm.SpaceName)))
+		}
+		return ""
 	}
 
-	projectsMap, environmentsMap, err := getMaps(req, server, apiKey, cacheDuration, spaces)
 	if err != nil {
-		return nil, nil, nil, err
+		qm.Notices = append(qm.Notices, newWarning("Failed to get the "+entityType+"s in "+describeSpace(qm.SpaceName)+", so the "+entityType+" '"+name+"' was matched by name: "+describeError(err)))
+		return ""
 	}
 
+	if id, ok := ids[name]; ok {
+		return id
+	}
+
+	qm.Notices = append(qm.Notices, newWarning(entityType+" '"+name+"' not found in "+describeSpace(qm.SpaceName)))
+	return ""
+}
+
+// prepareQueries looks through the queries, groups Octopus API calls to improve performance and remove redundant API calls, and returns the raw Octopus data.
+// The Octopus API calls are made concurrently, with up to concurrency requests running at once.
+// A query that can not be completed has its Error set, and any data that could not be found is listed in its Notices.
+func prepareQueries(ctx context.Context, client OctopusClient, concurrency int, req *backend.QueryDataRequest, spaces map[string]string) (queries []*queryModel, data map[string]*Deployments, generalEntityData map[string]map[string]string) {
+	ctx, span := startSpan(ctx, "prepareQueries")
+	defer span.End()
+
+	earliestDate, latestDate := getQueryDetails(req)
+
+	pool := newWorkerPool(concurrency)
+
+	projectsMap, environmentsMap, mapErrors := getMaps(ctx, client, pool, req, spaces)
+
 	// an array of parsed queries, with links back to the original backend query request
 	queries = []*queryModel{}
 	// A map of the Octopus query urls to the resulting deployments.
@@ -162,59 +321,131 @@ func prepareQueries(req *backend.QueryDataRequest, server string, apiKey string,
 	// A map of the Octopus REST API "all" endpoints we want to query.
 	// Again this is used to remove duplicate API queries.
 	generalEntityData = make(map[string]map[string]string)
+	// A map of the Octopus query urls to the errors they returned
+	dataErrors := make(map[string]error)
+	// The data maps are populated by the worker pool, so the writes are synchronised
+	var dataMutex sync.Mutex
+	// The urls that have been passed to the worker pool
+	requestedUrls := map[string]bool{}
+	// The reporting endpoint urls, and the queries that use them
+	reportingRequests := map[string]*reportingRequest{}
 
 	for i := 0; i < len(req.Queries); i++ {
 		// parse the query JSON into a struct
-		qm, _ := getQueryModel(req.Queries[i].JSON)
+		qm, err := getQueryModel(req.Queries[i])
 		// link back to the original backend query data
 		qm.Query = req.Queries[i]
 		// The list of parsed queries is a return value
 		queries = append(queries, &qm)
 
+		if err != nil {
+			qm.Error = errors.New("Failed to parse the query: " + err.Error())
+			continue
+		}
+
+		spaceId, err := getSpaceId(spaces, qm.SpaceName)
+		if err != nil {
+			// explain why there are no spaces to choose from on servers that predate them
+			if capabilities, capabilitiesErr := client.GetCapabilities(ctx); capabilitiesErr == nil && !capabilities.supports(spacesCapability) {
+				err = capabilities.require(spacesCapability)
+			}
+			qm.Error = err
+			continue
+		}
+
 		// get the deployments for each query
 		if qm.Format == "table" || qm.Format == "timeseries" {
 			// Get the ids of the entities being queried
-			projectId := ""
-			if val, ok := projectsMap[qm.SpaceName][qm.ProjectName]; ok && !empty(qm.ProjectName) {
-				projectId = val
-			}
-			environmentId := ""
-			if val, ok := environmentsMap[qm.SpaceName][qm.EnvironmentName]; ok && !empty(qm.EnvironmentName) {
-				environmentId = val
-			}
-			spaceId := ""
-			if val, ok := spaces[qm.SpaceName]; ok && !empty(qm.SpaceName) {
-				spaceId = val
-			}
+			projectId := getEntityId(&qm, "project", qm.Filters.projectName, projectsMap[qm.SpaceName], mapErrors[getMapKey(qm.SpaceName, "projects")])
+			environmentId := getEntityId(&qm, "environment", qm.Filters.environmentName, environmentsMap[qm.SpaceName], mapErrors[getMapKey(qm.SpaceName, "environments")])
+
+			// Each query tracks the url, relative to the server, that would generate the data.
+			url := buildReportingQueryUrl("", spaceId, environmentId, projectId, earliestDate, latestDate)
+			qm.OctopusQueryUrl = url
 
-			// Each query tracks the url that would generate the data.
-			qm.OctopusQueryUrl = buildReportingQueryUrl(server, spaceId, environmentId, projectId, earliestDate, latestDate)
-
-			// If the query url has not been accessed, hit the API to get the deployments.
-			if _, ok := data[qm.OctopusQueryUrl]; !ok {
-				// the deployments endpoint doesn't change, so we can assume a long cache lifetime
-				xmlData, err := createRequest(qm.OctopusQueryUrl, apiKey, longCache)
-				if err == nil {
-					// populate the data map with the results of the API query
-					data[qm.OctopusQueryUrl] = &Deployments{}
-					xml.Unmarshal(xmlData, data[qm.OctopusQueryUrl])
+			// The queries sharing a url are requested once, after all their filters are known
+			if request, ok := reportingRequests[url]; ok {
+				request.filter = append(request.filter, &qm)
+			} else {
+				reportingRequests[url] = &reportingRequest{
+					spaceId:       spaceId,
+					environmentId: environmentId,
+					projectId:     projectId,
+					filter:        reportingFilter{&qm},
 				}
 			}
 		} else {
-			// General entity endpoints return JSON, and can be retrieved via getAllResources()
-			url := getResourceUrl(qm.Format, server, spaces[qm.SpaceName])
-			// Each query tracks the url that would generate the data.
+			// General entity endpoints return JSON, and can be retrieved via GetResources()
+			url := getResourceUrl(qm.Format, "", spaceId)
+			// Each query tracks the url, relative to the server, that would generate the data.
 			qm.OctopusQueryUrl = url
 			// Get the entities if we haven't looked them up already
-			if _, ok := generalEntityData[url]; !ok {
-				entities, _ := getAllResources(qm.Format, server, spaces[qm.SpaceName], apiKey, cacheDuration)
-				// populate the generalEntityData map with the results of the API query
-				generalEntityData[url] = entities
+			if !requestedUrls[url] {
+				requestedUrls[url] = true
+
+				format := qm.Format
+				pool.Go(func() {
+					entities, err := client.GetResources(ctx, format, spaceId)
+
+					// populate the generalEntityData map with the results of the API query
+					dataMutex.Lock()
+					defer dataMutex.Unlock()
+					if err != nil {
+						dataErrors[url] = err
+					} else {
+						generalEntityData[url] = entities
+					}
+				})
 			}
 		}
 	}
 
-	return queries, data, generalEntityData, nil
+	// Hit the API to get the deployments, discarding those that none of the queries include
+	for url, request := range reportingRequests {
+		url := url
+		request := request
+		pool.Go(func() {
+			deployments, err := client.GetReportingDeployments(ctx, request.spaceId, request.environmentId, request.projectId, request.filter, earliestDate, latestDate)
+
+			// populate the data map with the results of the API query
+			dataMutex.Lock()
+			defer dataMutex.Unlock()
+			if err != nil {
+				dataErrors[url] = err
+			} else {
+				data[url] = deployments
+			}
+		})
+	}
+
+	pool.Wait()
+
+	// Each query reports the failure of the request it depends on
+	for _, qm := range queries {
+		if qm.Error != nil {
+			continue
+		}
+
+		if qm.Format == "table" || qm.Format == "timeseries" {
+			if err, ok := dataErrors[qm.OctopusQueryUrl]; ok {
+				qm.Error = newQueryError("Failed to get the deployments", err)
+			} else if data[qm.OctopusQueryUrl] == nil {
+				qm.Error = errors.New("Failed to get the deployments")
+			}
+		} else if err, ok := dataErrors[qm.OctopusQueryUrl]; ok {
+			qm.Error = newQueryError("Failed to get the "+qm.Format, err)
+		}
+	}
+
+	return queries, data, generalEntityData
+}
+
+// reportingRequest is a request to the reporting endpoint shared by one or more queries
+type reportingRequest struct {
+	spaceId       string
+	environmentId string
+	projectId     string
+	filter        reportingFilter
 }
 
 // CheckHealth handles health checks sent from Grafana to the plugin.
@@ -222,34 +453,13 @@ func prepareQueries(req *backend.QueryDataRequest, server string, apiKey string,
 // datasource configuration page which allows users to verify that
 // a datasource is working as expected.
 func (td *SampleDatasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
-	path, apiKey, cacheDuration := getConnectionDetails(req.PluginContext)
-
-	_, err := createRequest(path+"/api", apiKey, cacheDuration)
-
+	instance, err := td.getInstance(req.PluginContext)
 	if err != nil {
 		return &backend.CheckHealthResult{
 			Status:  backend.HealthStatusError,
-			Message: "Failed to contact Octopus server, or API key is invalid",
+			Message: "Failed to create the datasource instance: " + err.Error(),
 		}, nil
 	}
 
-	return &backend.CheckHealthResult{
-		Status:  backend.HealthStatusOk,
-		Message: "Data source is working",
-	}, nil
-}
-
-type instanceSettings struct {
-	httpClient *http.Client
-}
-
-func newDataSourceInstance(setting backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
-	return &instanceSettings{
-		httpClient: &http.Client{},
-	}, nil
-}
-
-func (s *instanceSettings) Dispose() {
-	// Called before creating a new instance to allow plugin authors
-	// to cleanup.
+	return checkHealth(ctx, instance.client, instance.concurrency), nil
 }
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/datasource"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeOctopusClient returns fixed results in place of an Octopus server
+type fakeOctopusClient struct {
+	// version defaults to 2020.1.0
+	version     string
+	spaces      map[string]string
+	resources   map[string]map[string]string
+	releases    map[string]Release
+	deployments []Deployment
+	permissions UserPermissions
+	// errors are returned in place of the resource type, or "release", "reporting", "user" and "reporting/<space id>"
+	// for those requests
+	errors map[string]error
+}
+
+func (c *fakeOctopusClient) GetApiRoot(ctx context.Context) (ApiRoot, error) {
+	return ApiRoot{Application: "Octopus Deploy", Version: c.getVersion(), ApiVersion: "3.0.0"}, nil
+}
+
+func (c *fakeOctopusClient) GetCapabilities(ctx context.Context) (serverCapabilities, error) {
+	return newServerCapabilities(c.getVersion()), nil
+}
+
+// getVersion returns the version of Octopus the client pretends to connect to
+func (c *fakeOctopusClient) getVersion() string {
+	if empty(c.version) {
+		return "2020.1.0"
+	}
+	return c.version
+}
+
+func (c *fakeOctopusClient) GetSpaces(ctx context.Context) (map[string]string, error) {
+	return c.spaces, nil
+}
+
+func (c *fakeOctopusClient) GetResources(ctx context.Context, resourceType string, spaceId string) (map[string]string, error) {
+	if err := c.errors[resourceType]; err != nil {
+		return nil, err
+	}
+	if resourceType == "spaces" {
+		return c.spaces, nil
+	}
+	return c.resources[resourceType], nil
+}
+
+func (c *fakeOctopusClient) GetDeployments(ctx context.Context, spaceId string, projectId string, environmentId string, skip int, take int, earliestDate time.Time, latestDate time.Time) ([]PlainDeployment, error) {
+	return []PlainDeployment{}, nil
+}
+
+func (c *fakeOctopusClient) GetRelease(ctx context.Context, spaceId string, releaseId string) (Release, error) {
+	if err := c.errors["release"]; err != nil {
+		return Release{}, err
+	}
+	return c.releases[releaseId], nil
+}
+
+func (c *fakeOctopusClient) GetReportingDeployments(ctx context.Context, spaceId string, environmentId string, projectId string, filter reportingFilter, earliestDate time.Time, latestDate time.Time) (*Deployments, error) {
+	if err := c.errors["reporting"]; err != nil {
+		return nil, err
+	}
+	deployments := []Deployment{}
+	for _, deployment := range c.deployments {
+		if (empty(projectId) || deployment.ProjectId == projectId) && (empty(environmentId) || deployment.EnvironmentId == environmentId) {
+			parseDeploymentTimes(&deployment)
+			deployments = append(deployments, deployment)
+		}
+	}
+	return &Deployments{Deployments: deployments}, nil
+}
+
+func (c *fakeOctopusClient) GetCurrentUser(ctx context.Context) (User, error) {
+	if err := c.errors["user"]; err != nil {
+		return User{}, err
+	}
+	return User{Id: "Users-1", Username: "grafana"}, nil
+}
+
+func (c *fakeOctopusClient) GetUserPermissions(ctx context.Context, userId string) (UserPermissions, error) {
+	return c.permissions, nil
+}
+
+func (c *fakeOctopusClient) CheckReportingAccess(ctx context.Context, spaceId string) error {
+	return c.errors["reporting/"+spaceId]
+}
+
+// newFakeDatasource returns a datasource whose instances all use the client
+func newFakeDatasource(client OctopusClient) *SampleDatasource {
+	return &SampleDatasource{
+		im: datasource.NewInstanceManager(func(setting backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
+			return &instanceSettings{client: client, concurrency: 1}, nil
+		}),
+	}
+}
+
+func newFakeOctopusClient() *fakeOctopusClient {
+	return &fakeOctopusClient{
+		spaces: map[string]string{"Default": "Spaces-1"},
+		resources: map[string]map[string]string{
+			"projects":     {"Web": "Projects-1", "Database": "Projects-2"},
+			"environments": {"Production": "Environments-1"},
+		},
+		releases: map[string]Release{
+			"Releases-1": {Id: "Releases-1", AssembledDate: time.Date(2021, 1, 1, 9, 0, 0, 0, time.UTC)},
+		},
+		deployments: []Deployment{
+			{DeploymentId: "Deployments-1", ProjectId: "Projects-1", ProjectName: "Web", EnvironmentId: "Environments-1", EnvironmentName: "Production", ReleaseId: "Releases-1", TaskState: "Success", StartTime: "2021-01-01T09:55:00", CompletedTime: "2021-01-01T10:00:00", DurationSeconds: 300},
+			{DeploymentId: "Deployments-2", ProjectId: "Projects-2", ProjectName: "Database", EnvironmentId: "Environments-1", EnvironmentName: "Production", ReleaseId: "Releases-2", TaskState: "Failed", StartTime: "2021-01-01T10:58:00", CompletedTime: "2021-01-01T11:00:00", DurationSeconds: 120},
+			{DeploymentId: "Deployments-3", ProjectId: "Projects-1", ProjectName: "Web", EnvironmentId: "Environments-1", EnvironmentName: "Production", ReleaseId: "Releases-1", TaskState: "Failed", StartTime: "2021-01-01T11:59:00", CompletedTime: "2021-01-01T12:00:00", DurationSeconds: 60},
+		},
+	}
+}
+
+// newFakeClientContext returns the context of the datasource used with a fake client
+func newFakeClientContext() backend.PluginContext {
+	return backend.PluginContext{DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{ID: 1}}
+}
+
+// newFakeQueryDataRequest returns a request for a single query over the first day of 2021, in hourly buckets
+func newFakeQueryDataRequest(pluginContext backend.PluginContext, queryJson string) *backend.QueryDataRequest {
+	query := backend.DataQuery{
+		RefID:         "A",
+		JSON:          []byte(queryJson),
+		MaxDataPoints: 24,
+	}
+	query.TimeRange.From = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	query.TimeRange.To = time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	return &backend.QueryDataRequest{
+		PluginContext: pluginContext,
+		Queries:       []backend.DataQuery{query},
+	}
+}
+
+// getField returns the field of a frame with the name
+func getField(t *testing.T, frame *data.Frame, name string) *data.Field {
+	for _, field := range frame.Fields {
+		if field.Name == name {
+			return field
+		}
+	}
+	t.Fatalf("expected the frame to have a %s field", name)
+	return nil
+}
+
+func TestQueryDataTableWithFakeClient(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		expected []string
+	}{
+		{"space", `{"format": "table", "spaceName": "Default"}`, []string{"Deployments-1", "Deployments-2", "Deployments-3"}},
+		{"project", `{"format": "table", "spaceName": "Default", "projectName": "Web"}`, []string{"Deployments-1", "Deployments-3"}},
+		{"task state", `{"format": "table", "spaceName": "Default", "TaskState": "Failed"}`, []string{"Deployments-2", "Deployments-3"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, err := newFakeDatasource(newFakeOctopusClient()).QueryData(context.Background(), newFakeQueryDataRequest(newFakeClientContext(), test.query))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			frame := response.Responses["A"].Frames[0]
+			field := getField(t, frame, "deploymentid")
+			if field.Len() != len(test.expected) {
+				t.Fatalf("expected %d deployments, got %d", len(test.expected), field.Len())
+			}
+
+			for i, id := range test.expected {
+				if field.At(i).(string) != id {
+					t.Fatalf("expected deployment %d to be %s, got %s", i, id, field.At(i))
+				}
+			}
+		})
+	}
+}
+
+func TestQueryDataTimeseriesWithFakeClient(t *testing.T) {
+	request := newFakeQueryDataRequest(newFakeClientContext(), `{"format": "timeseries", "spaceName": "Default", "projectName": "Web", "successField": true, "failureField": true, "totalCycleTimeField": true}`)
+	response, err := newFakeDatasource(newFakeOctopusClient()).QueryData(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := response.Responses["A"].Frames[0]
+	times := getField(t, frame, "time")
+	success := getField(t, frame, "success")
+	failure := getField(t, frame, "failure")
+	cycleTime := getField(t, frame, "totalReleaseLeadTime")
+
+	totals := map[time.Time][3]uint32{}
+	for i := 0; i < times.Len(); i++ {
+		totals[times.At(i).(time.Time)] = [3]uint32{success.At(i).(uint32), failure.At(i).(uint32), cycleTime.At(i).(uint32)}
+	}
+
+	ten := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	twelve := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	if totals[ten] != [3]uint32{1, 0, 3600} {
+		t.Fatalf("expected a successful deployment an hour after the release at 10:00, got %v", totals[ten])
+	}
+
+	if totals[twelve] != [3]uint32{0, 1, 10800} {
+		t.Fatalf("expected a failed deployment three hours after the release at 12:00, got %v", totals[twelve])
+	}
+
+	if eleven := totals[time.Date(2021, 1, 1, 11, 0, 0, 0, time.UTC)]; eleven != [3]uint32{} {
+		t.Fatalf("expected the deployment of another project to be filtered, got %v", eleven)
+	}
+}
+
+func TestQueryDataReportsErrorsPerQuery(t *testing.T) {
+	forbidden := func(permission string) error {
+		return &responseError{url: "http://octopus", statusCode: http.StatusForbidden, message: "You do not have permission to perform this action. Missing permission: " + permission}
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		errors map[string]error
+		// the expected error, or an empty string if the query returns a frame
+		expectedError string
+		// the expected notices displayed with the frame
+		expectedNotices []string
+	}{
+		{
+			name:          "unknown space",
+			query:         `{"format": "table", "spaceName": "Foo"}`,
+			expectedError: "space 'Foo' not found",
+		},
+		{
+			name:          "spaces forbidden",
+			query:         `{"format": "table", "spaceName": "Default"}`,
+			errors:        map[string]error{"spaces": forbidden("SpaceView")},
+			expectedError: "Failed to get the spaces: 403 from Octopus: missing SpaceView",
+		},
+		{
+			name:          "deployments forbidden",
+			query:         `{"format": "table", "spaceName": "Default"}`,
+			errors:        map[string]error{"reporting": forbidden("DeploymentView")},
+			expectedError: "Failed to get the deployments: 403 from Octopus: missing DeploymentView",
+		},
+		{
+			name:          "resources forbidden",
+			query:         `{"format": "tenants", "spaceName": "Default"}`,
+			errors:        map[string]error{"tenants": forbidden("TenantView")},
+			expectedError: "Failed to get the tenants: 403 from Octopus: missing TenantView",
+		},
+		{
+			name:            "projects forbidden",
+			query:           `{"format": "table", "spaceName": "Default", "projectName": "Web"}`,
+			errors:          map[string]error{"projects": forbidden("ProjectView")},
+			expectedNotices: []string{"Failed to get the projects in space 'Default', so the project 'Web' was matched by name: 403 from Octopus: missing ProjectView"},
+		},
+		{
+			name:            "unknown project",
+			query:           `{"format": "table", "spaceName": "Default", "projectName": "Mobile"}`,
+			expectedNotices: []string{"project 'Mobile' not found in space 'Default'"},
+		},
+		{
+			name:            "unknown projects in a list",
+			query:           `{"format": "table", "spaceName": "Default", "projectName": "{Web,Mobile,Desktop}"}`,
+			expectedNotices: []string{"projects 'Desktop', 'Mobile' not found in space 'Default'"},
+		},
+		{
+			name:          "template variable not replaced",
+			query:         `{"format": "table", "spaceName": "Default", "projectName": "$project"}`,
+			expectedError: "Failed to parse the query: the project filter $project is a template variable that was not replaced. Use the All value of the variable to match every project",
+		},
+		{
+			name:          "invalid bucket interval",
+			query:         `{"format": "timeseries", "spaceName": "Default", "bucketInterval": "hourly"}`,
+			expectedError: "Failed to parse the query: the interval 'hourly' is not a duration like 30s, 5m or 1d",
+		},
+		{
+			name:          "invalid regular expression",
+			query:         `{"format": "table", "spaceName": "Default", "environmentName": "/[a-/"}`,
+			expectedError: "Failed to parse the query: the environment filter '/[a-/' is not a valid regular expression: error parsing regexp: missing closing ]: `[a-`",
+		},
+		{
+			name:            "releases forbidden",
+			query:           `{"format": "timeseries", "spaceName": "Default", "projectName": "Web", "totalCycleTimeField": true}`,
+			errors:          map[string]error{"release": forbidden("ReleaseView")},
+			expectedNotices: []string{"The release lead time excludes 2 deployments whose release could not be read: 403 from Octopus: missing ReleaseView"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newFakeOctopusClient()
+			client.errors = test.errors
+
+			// the failing query is sent with a query that works, which must not be affected by the failure
+			request := newFakeQueryDataRequest(newFakeClientContext(), test.query)
+			working := request.Queries[0]
+			working.RefID = "B"
+			working.JSON = []byte(`{"format": "environments", "spaceName": "Default"}`)
+			request.Queries = append(request.Queries, working)
+
+			response, err := newFakeDatasource(client).QueryData(context.Background(), request)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual := response.Responses["A"]
+			if !empty(test.expectedError) {
+				if actual.Error == nil || actual.Error.Error() != test.expectedError {
+					t.Fatalf("expected the error %q, got %v", test.expectedError, actual.Error)
+				}
+			} else {
+				if actual.Error != nil {
+					t.Fatalf("expected a frame, got the error %s", actual.Error)
+				}
+
+				notices := []string{}
+				if actual.Frames[0].Meta != nil {
+					for _, notice := range actual.Frames[0].Meta.Notices {
+						notices = append(notices, notice.Text)
+					}
+				}
+				if !reflect.DeepEqual(notices, test.expectedNotices) {
+					t.Fatalf("expected the notices %q, got %q", test.expectedNotices, notices)
+				}
+			}
+
+			if test.errors["spaces"] == nil && response.Responses["B"].Error != nil {
+				t.Fatalf("expected the other query to succeed, got %s", response.Responses["B"].Error)
+			}
+		})
+	}
+}
+
+func TestCheckHealthPermissions(t *testing.T) {
+	allSpaces := map[string][]PermissionRestriction{}
+	for _, permission := range requiredPermissions {
+		allSpaces[permission] = []PermissionRestriction{{SpaceId: ""}}
+	}
+
+	defaultOnly := map[string][]PermissionRestriction{}
+	for _, permission := range requiredPermissions {
+		defaultOnly[permission] = []PermissionRestriction{{SpaceId: "Spaces-1"}}
+	}
+	delete(defaultOnly, "TenantView")
+
+	tests := []struct {
+		name            string
+		permissions     map[string][]PermissionRestriction
+		errors          map[string]error
+		expected        backend.HealthStatus
+		expectedMessage string
+		expectedMissing map[string][]string
+	}{
+		{
+			name:            "all permissions",
+			permissions:     allSpaces,
+			expected:        backend.HealthStatusOk,
+			expectedMessage: "Connected to Octopus 2020.1.0 as grafana. The reporting endpoint can be read in 2 spaces, which have all the required permissions",
+		},
+		{
+			name:            "missing permissions",
+			permissions:     defaultOnly,
+			expected:        backend.HealthStatusError,
+			expectedMessage: "Connected to Octopus 2020.1.0 as grafana, but space 'Default' is missing TenantView; space 'Operations' is missing DeploymentView, EnvironmentView, ProcessView, ProjectView, ReleaseView, TenantView",
+			expectedMissing: map[string][]string{"Default": {"TenantView"}, "Operations": requiredPermissions},
+		},
+		{
+			name:            "reporting forbidden",
+			permissions:     allSpaces,
+			errors:          map[string]error{"reporting/Spaces-2": &responseError{statusCode: http.StatusForbidden, message: "Missing permission: DeploymentView"}},
+			expected:        backend.HealthStatusError,
+			expectedMessage: "Connected to Octopus 2020.1.0 as grafana, but space 'Operations' can not read the reporting endpoint: 403 from Octopus: missing DeploymentView",
+		},
+		{
+			name:            "permissions unreadable",
+			errors:          map[string]error{"user": &responseError{statusCode: http.StatusNotFound}},
+			expected:        backend.HealthStatusOk,
+			expectedMessage: "Connected to Octopus 2020.1.0. The reporting endpoint can be read in 2 spaces, but the permissions were not checked: 404 from Octopus: Not Found",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newFakeOctopusClient()
+			client.spaces = map[string]string{"Default": "Spaces-1", "Operations": "Spaces-2"}
+			client.permissions = UserPermissions{SpacePermissions: test.permissions}
+			client.errors = test.errors
+
+			result, err := newFakeDatasource(client).CheckHealth(context.Background(), &backend.CheckHealthRequest{PluginContext: newFakeClientContext()})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result.Status != test.expected || result.Message != test.expectedMessage {
+				t.Fatalf("expected %v %q, got %v %q", test.expected, test.expectedMessage, result.Status, result.Message)
+			}
+
+			var details healthDetails
+			err = json.Unmarshal(result.JSONDetails, &details)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for spaceName, expected := range test.expectedMissing {
+				if actual := details.Spaces[spaceName].MissingPermissions; !reflect.DeepEqual(actual, expected) {
+					t.Errorf("expected %s to be missing %v, got %v", spaceName, expected, actual)
+				}
+			}
+		})
+	}
+}
+
+func TestQueryDataOnServersWithoutSpaces(t *testing.T) {
+	client := newFakeOctopusClient()
+	client.version = "2018.10.0"
+	client.spaces = map[string]string{}
+
+	request := newFakeQueryDataRequest(newFakeClientContext(), `{"format": "table", "spaceName": "Default"}`)
+	response, err := newFakeDatasource(client).QueryData(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "Spaces is not supported on Octopus 2018.10, and requires Octopus 2019.1 or later"
+	if err := response.Responses["A"].Error; err == nil || err.Error() != expected {
+		t.Fatalf("expected the error %q, got %v", expected, err)
+	}
+
+	result, err := newFakeDatasource(client).CheckHealth(context.Background(), &backend.CheckHealthRequest{PluginContext: request.PluginContext})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected = "Connected to Octopus 2018.10.0 as grafana. The reporting endpoint can be read in 1 spaces, but the permissions were not checked: Spaces is not supported on Octopus 2018.10, and requires Octopus 2019.1 or later"
+	if result.Status != backend.HealthStatusOk || result.Message != expected {
+		t.Fatalf("expected %q, got %v %q", expected, result.Status, result.Message)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"encoding/xml"
 	"time"
 )
@@ -8,32 +9,64 @@ import (
 // BaseResource represents the object holding the common details for any table query. Almost all
 // resources are a name/ID combination, but some others like releases are version/ID.
 type BaseResource struct {
-	Name    string `json:Name`
-	Id      string `json:Id`
-	Version string `json:Version`
+	Name    string `json:"Name"`
+	Id      string `json:"Id"`
+	Version string `json:"Version"`
 }
 
-type PlainDeploymentItems struct {
-	Items []PlainDeployment `json:Items`
+// PagedCollection is the envelope Octopus wraps around the results of collection endpoints
+// like /api/deployments and /api/releases. The items are left as raw JSON so the one reader
+// can be used for any resource type.
+type PagedCollection struct {
+	ItemType     string            `json:"ItemType"`
+	TotalResults int               `json:"TotalResults"`
+	ItemsPerPage int               `json:"ItemsPerPage"`
+	Items        []json.RawMessage `json:"Items"`
+	Links        map[string]string `json:"Links"`
 }
 
 type PlainDeployment struct {
-	Name          string `json:Name`
-	Id            string `json:Id`
+	Name          string `json:"Name"`
+	Id            string `json:"Id"`
 	Created       string `xml:"Created"`
 	CreatedParsed time.Time
 }
 
+// ApiRoot is returned by the root of the Octopus API
+type ApiRoot struct {
+	Application string `json:"Application"`
+	Version     string `json:"Version"`
+	ApiVersion  string `json:"ApiVersion"`
+}
+
+// User is the Octopus user that owns the API key
+type User struct {
+	Id       string `json:"Id"`
+	Username string `json:"Username"`
+}
+
+// UserPermissions is the permission set returned by /api/users/{id}/permissions
+type UserPermissions struct {
+	// SpacePermissions maps each permission to where it has been granted
+	SpacePermissions  map[string][]PermissionRestriction `json:"SpacePermissions"`
+	SystemPermissions []string                           `json:"SystemPermissions"`
+}
+
+// PermissionRestriction is a grant of a permission. A grant with no space applies to every space.
+type PermissionRestriction struct {
+	SpaceId string `json:"SpaceId"`
+}
+
 type SpaceResource struct {
-	Name      string `json:Name`
-	Id        string `json:Id`
-	IsDefault bool   `json:IsDefault`
+	Name      string `json:"Name"`
+	Id        string `json:"Id"`
+	IsDefault bool   `json:"IsDefault"`
 }
 
 type Release struct {
-	Name          string `json:Name`
-	Id            string `json:Id`
-	Assembled     string `json:Assembled`
+	Name          string `json:"Name"`
+	Id            string `json:"Id"`
+	Assembled     string `json:"Assembled"`
 	AssembledDate time.Time
 }
 
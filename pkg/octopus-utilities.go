@@ -2,13 +2,9 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
-	"github.com/dgraph-io/ristretto"
-	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
-	"io/ioutil"
-	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,104 +13,24 @@ var longCache = "24h"
 
 // any failed http request will be cached for a short time as a circuit breaker
 var failedDuration, _ = time.ParseDuration("1m")
-var cache, cacheErr = ristretto.NewCache(&ristretto.Config{
-	/*
-	    NumCounters is the number of 4-bit access counters to keep for admission and eviction.
-	  We've seen good performance in setting this to 10x the number of items you expect to keep in the cache when full.
-	*/
-	NumCounters: 10000,
-	/*
-	  MaxCost is how eviction decisions are made. For example, if MaxCost is 100 and a new item with a
-	  cost of 1 increases total cache cost to 101, 1 item will be evicted.
-	*/
-	MaxCost: 1 << 8, // maximum cost of cache (100mb).
-	/*
-	  BufferItems is the size of the Get buffers. The best value we've found for this is 64.
-	*/
-	BufferItems: 64, // number of keys per Get buffer.
-})
 
-func createRequest(url string, apiKey string, cacheDuration string) ([]byte, error) {
-	log.DefaultLogger.Debug("GET request to " + url)
-
-	// load the cached result
-	if cacheErr == nil {
-		value, found := cache.Get(url)
-		if found {
-			log.DefaultLogger.Debug("Cache hit on " + url)
-
-			if value == nil {
-				log.DefaultLogger.Error("Cached response was nil. This is a circuit breaker for a failed request to " + url)
-				return nil, errors.New("Cached response was nil. This is a circuit breaker for a failed request to " + url)
-			}
-
-			return value.([]byte), nil
-		}
-	} else {
-		log.DefaultLogger.Error("Caching was not enabled because " + cacheErr.Error() + ".")
-	}
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("X-Octopus-ApiKey", apiKey)
-
-	client := &http.Client{Timeout: time.Second * 100}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-
-		if cacheErr == nil && !empty(cacheDuration) {
-			cache.SetWithTTL(url, nil, 1, failedDuration)
-		}
-
-		errorCode := strconv.Itoa(resp.StatusCode)
-		log.DefaultLogger.Error("Response code to " + url + " was " + errorCode)
-		return nil, errors.New("Response code to " + url + " was " + errorCode)
-	}
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.DefaultLogger.Error("GET request to " + url + " failed: " + err.Error())
-		return nil, err
-	}
-
-	log.DefaultLogger.Debug("GET request to " + url + " responded with:")
-	log.DefaultLogger.Debug(string(body[:]))
-
-	// cache the result
-	if cacheErr == nil && !empty(cacheDuration) {
-		duration, durationError := time.ParseDuration(cacheDuration)
-		if durationError == nil {
-			cache.SetWithTTL(url, body, 1, duration)
-		} else {
-			log.DefaultLogger.Error("Could not parse duration: " + cacheDuration + ". Caching is disabled.")
-		}
-	}
-
-	return body, nil
+// pagedResources are the resources that have no "all" endpoint, and instead return a PagedCollection
+var pagedResources = map[string]bool{
+	"deployments": true,
+	"releases":    true,
 }
 
+// defaultPageSize is the number of items requested with each page of a PagedCollection
+const defaultPageSize = 100
+
 func getResourceUrl(resourceType string, server string, space string) string {
 	nonSpaceResources := map[string]bool{
 		"spaces": true,
 		"users":  true,
 	}
 
-	noAllResource := map[string]bool{
-		"deployments": true,
-		"releases":    true,
-	}
-
 	_, isNonSpace := nonSpaceResources[resourceType]
-	_, isNoAllResource := noAllResource[resourceType]
+	_, isNoAllResource := pagedResources[resourceType]
 
 	if !empty(space) && !isNonSpace {
 		// spaced resources use the space path
@@ -133,122 +49,57 @@ func getResourceUrl(resourceType string, server string, space string) string {
 	}
 }
 
-// getSpaceResources calls the "all" API endpoint to return all available resources in a name to id map
-func getSpaceResources(server string, apiKey string, cacheDuration string) (map[string]string, error) {
-	url := getResourceUrl("spaces", server, "")
+// pagedItemTime returns the time associated with an item in a PagedCollection. It is used to stop
+// reading pages once the items fall outside of the requested time range.
+type pagedItemTime func(item json.RawMessage) (time.Time, error)
 
-	body, err := createRequest(url, apiKey, cacheDuration)
+// setPagingParams sets the skip and take query parameters on a collection url
+func setPagingParams(collectionUrl string, skip int, take int) (string, error) {
+	parsedUrl, err := url.Parse(collectionUrl)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	var parsedResults []SpaceResource
-	err = json.Unmarshal(body, &parsedResults)
-
-	if err == nil {
-		results := make(map[string]string)
-		for _, r := range parsedResults {
-			results[r.Name] = r.Id
-			// the default space is the unnamed space, identified as a single space
-			if r.IsDefault {
-				results[" "] = r.Id
-			}
-		}
-		return results, nil
-	}
+	query := parsedUrl.Query()
+	query.Set("skip", strconv.Itoa(skip))
+	query.Set("take", strconv.Itoa(take))
+	parsedUrl.RawQuery = query.Encode()
 
-	return nil, err
+	return parsedUrl.String(), nil
 }
 
-// getAllResources calls the "all" API endpoint to return all available resources in a name to id map
-func getAllResources(resourceType string, server string, space string, apiKey string, cacheDuration string) (map[string]string, error) {
-	url := getResourceUrl(resourceType, server, space)
-
-	body, err := createRequest(url, apiKey, cacheDuration)
-	if err != nil {
-		return nil, err
+// resolveLink converts a link returned by the Octopus API into an absolute url. Links starting with "~/" are
+// relative to the server url, while other links are relative to the root of the server host.
+func resolveLink(server string, link string) string {
+	if empty(link) {
+		return ""
 	}
 
-	var parsedResults []BaseResource
-	err = json.Unmarshal(body, &parsedResults)
-
-	if err == nil {
-		results := make(map[string]string)
-		for _, r := range parsedResults {
-			if !empty(r.Version) {
-				results[r.Version] = r.Id
-			} else {
-				results[r.Name] = r.Id
-			}
-		}
-		return results, nil
-	}
-
-	return nil, err
-}
-
-// getDeployments returns the a list of deployments
-func getDeployments(server string, space string, apiKey string, cacheDuration string, projectId string, environmentId string) ([]PlainDeployment, error) {
-	var url string
-
-	if !empty(space) {
-		url = server + "/api/" + space + "/deployments"
-	} else {
-		url = server + "/api/deployments"
+	if strings.HasPrefix(link, "~/") {
+		return strings.TrimSuffix(server, "/") + link[1:]
 	}
 
-	url += "?projects=" + projectId + "&environments=" + environmentId
-
-	body, err := createRequest(url, apiKey, cacheDuration)
+	serverUrl, err := url.Parse(server)
 	if err != nil {
-		return []PlainDeployment{}, err
+		return ""
 	}
 
-	var parsedResults PlainDeploymentItems
-	err = json.Unmarshal(body, &parsedResults)
-
-	if err == nil {
-		for index := 0; index < len(parsedResults.Items); index++ {
-			time, err := time.Parse(dateFormat, parsedResults.Items[index].Created)
-			if err == nil {
-				parsedResults.Items[index].CreatedParsed = time
-			} else {
-				log.DefaultLogger.Error("Failed to parse date " + parsedResults.Items[index].Created)
-			}
-		}
-		return parsedResults.Items, nil
+	linkUrl, err := url.Parse(link)
+	if err != nil {
+		return ""
 	}
 
-	return []PlainDeployment{}, err
+	return serverUrl.ResolveReference(linkUrl).String()
 }
 
-// getRelease returns the details of a specific release
-func getRelease(releaseId string, server string, space string, apiKey string) (Release, error) {
-	var url string
-
-	if !empty(space) {
-		url = server + "/api/" + space + "/releases/" + releaseId
-	} else {
-		url = server + "/api/releases/" + releaseId
-	}
-
-	body, err := createRequest(url, apiKey, longCache)
+// plainDeploymentCreated returns the creation time of a deployment in a PagedCollection
+func plainDeploymentCreated(item json.RawMessage) (time.Time, error) {
+	var deployment PlainDeployment
+	err := json.Unmarshal(item, &deployment)
 	if err != nil {
-		return Release{}, err
+		return time.Time{}, err
 	}
-
-	var parsedResults Release
-	err = json.Unmarshal(body, &parsedResults)
-
-	if err == nil {
-		time, err := time.Parse(dateFormat, parsedResults.Assembled)
-		if err == nil {
-			parsedResults.AssembledDate = time
-		}
-		return parsedResults, nil
-	}
-
-	return Release{}, err
+	return time.Parse(dateFormat, deployment.Created)
 }
 
 // getTimeToSuccess will match failed deployments, find the next successful deployment
@@ -284,12 +135,12 @@ func buildReportingQueryUrl(server string, spaceId string, environmentId string,
 	// Build the Octopus API URL
 	if empty(spaceId) {
 		query = server + "/api/reporting/deployments/xml?" +
-			"fromCompletedTime=" + url.QueryEscape(earliestDate.Format(octopusDateFormat)) +
-			"&toCompletedTime=" + url.QueryEscape(latestDate.Format(octopusDateFormat))
+			"fromCompletedTime=" + url.QueryEscape(earliestDate.UTC().Format(octopusDateFormat)) +
+			"&toCompletedTime=" + url.QueryEscape(latestDate.UTC().Format(octopusDateFormat))
 	} else {
 		query = server + "/api/" + spaceId + "/reporting/deployments/xml?" +
-			"fromCompletedTime=" + url.QueryEscape(earliestDate.Format(octopusDateFormat)) +
-			"&toCompletedTime=" + url.QueryEscape(latestDate.Format(octopusDateFormat))
+			"fromCompletedTime=" + url.QueryEscape(earliestDate.UTC().Format(octopusDateFormat)) +
+			"&toCompletedTime=" + url.QueryEscape(latestDate.UTC().Format(octopusDateFormat))
 	}
 
 	// Filter server side on the project
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestResolveLink(t *testing.T) {
+	tests := []struct {
+		server   string
+		link     string
+		expected string
+	}{
+		{"http://octopus", "/api/deployments?skip=30", "http://octopus/api/deployments?skip=30"},
+		{"http://octopus/", "/api/deployments?skip=30", "http://octopus/api/deployments?skip=30"},
+		{"http://host/octopus", "~/api/deployments?skip=30", "http://host/octopus/api/deployments?skip=30"},
+		{"http://octopus", "", ""},
+	}
+
+	for _, test := range tests {
+		if actual := resolveLink(test.server, test.link); actual != test.expected {
+			t.Errorf("resolveLink(%q, %q) = %q, expected %q", test.server, test.link, actual, test.expected)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// durationBuckets cover quick cached lookups through to reporting requests spanning a long time range
+var durationBuckets = prometheus.ExponentialBuckets(0.005, 2, 16)
+
+var (
+	octopusRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "octopus_datasource_octopus_request_duration_seconds",
+		Help:    "The time taken by requests to Octopus, until the response body was read, by endpoint and status. The count is the number of requests, including retries.",
+		Buckets: durationBuckets,
+	}, []string{"datasource", "endpoint", "status"})
+	circuitBreakerTrips = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "octopus_datasource_circuit_breaker_trips_total",
+		Help: "The number of failed Octopus requests that stopped the url being requested again for a while.",
+	}, []string{"datasource"})
+	reportingCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "octopus_datasource_reporting_cache_requests_total",
+		Help: "The number of reporting endpoint lookups, by whether they were served from the cache (hit) or needed a request to Octopus (miss).",
+	}, []string{"datasource", "result"})
+	reportingRecordsParsed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "octopus_datasource_reporting_records_parsed_total",
+		Help: "The number of deployment records parsed from reporting endpoint responses, by whether the filters of a query kept or discarded them.",
+	}, []string{"datasource", "result"})
+	queryDataDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "octopus_datasource_query_data_duration_seconds",
+		Help:    "The time taken to answer each query sent by Grafana, by format. This includes the requests to Octopus made for the query.",
+		Buckets: durationBuckets,
+	}, []string{"datasource", "format"})
+	queryFrameDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "octopus_datasource_query_frame_duration_seconds",
+		Help:    "The time taken to build the frame for each query from the data returned by Octopus, by format.",
+		Buckets: durationBuckets,
+	}, []string{"datasource", "format"})
+)
+
+func init() {
+	// The plugin SDK exposes the default registry through the Grafana plugin metrics endpoint
+	prometheus.MustRegister(octopusRequestDuration, circuitBreakerTrips, reportingCacheRequests, reportingRecordsParsed, queryDataDuration, queryFrameDuration)
+}
+
+// idSegmentRegex matches the path segments holding Octopus ids, like Spaces-1 or Releases-123
+var idSegmentRegex = regexp.MustCompile(`^[A-Za-z]+-[0-9]+$`)
+
+// getEndpointTemplate returns the path of an Octopus url with the ids replaced by placeholders, so requests for
+// different resources of the same type share a label. Anything before /api, like a virtual directory, is removed.
+func getEndpointTemplate(path string) string {
+	if index := strings.Index(path, "/api"); index >= 0 {
+		path = path[index:]
+	}
+
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if idSegmentRegex.MatchString(segment) {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// getRequestStatus returns the status label of a request that did not return a response
+func getRequestStatus(err error) string {
+	if errors.Is(err, context.Canceled) {
+		return "cancelled"
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	return "error"
+}
+
+// metricsTransport records the duration and status of each request to Octopus. The duration runs until the
+// response body is closed, so streamed responses include the time taken to read them.
+type metricsTransport struct {
+	datasource string
+	base       http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	endpoint := getEndpointTemplate(req.URL.Path)
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		octopusRequestDuration.WithLabelValues(t.datasource, endpoint, getRequestStatus(err)).Observe(time.Since(start).Seconds())
+		return nil, err
+	}
+
+	status := strconv.Itoa(resp.StatusCode)
+	resp.Body = &observedBody{ReadCloser: resp.Body, observe: func() {
+		octopusRequestDuration.WithLabelValues(t.datasource, endpoint, status).Observe(time.Since(start).Seconds())
+	}}
+	return resp, nil
+}
+
+func (t *metricsTransport) CloseIdleConnections() {
+	if closer, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// observedBody records the duration of a request once its response body is closed
+type observedBody struct {
+	io.ReadCloser
+	observe func()
+	once    sync.Once
+}
+
+func (b *observedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.observe)
+	return err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"testing"
+)
+
+// getHistogramCount returns the number of observations recorded by the histogram with the labels
+func getHistogramCount(t *testing.T, histogram *prometheus.HistogramVec, labels ...string) uint64 {
+	metric := &dto.Metric{}
+	err := histogram.WithLabelValues(labels...).(prometheus.Metric).Write(metric)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestGetEndpointTemplate(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/api", "/api"},
+		{"/api/spaces/all", "/api/spaces/all"},
+		{"/api/Spaces-1/projects/all", "/api/{id}/projects/all"},
+		{"/api/Spaces-12/releases/Releases-345", "/api/{id}/releases/{id}"},
+		{"/octopus/api/Spaces-1/reporting/deployments/xml", "/api/{id}/reporting/deployments/xml"},
+		{"/api/users/me", "/api/users/me"},
+	}
+
+	for _, test := range tests {
+		if actual := getEndpointTemplate(test.path); actual != test.expected {
+			t.Errorf("expected %s to be %s, got %s", test.path, test.expected, actual)
+		}
+	}
+}
+
+func TestQueryDataRecordsMetrics(t *testing.T) {
+	server := newFakeOctopusServer(t)
+	defer server.Close()
+
+	reportingEndpoint := "/api/{id}/reporting/deployments/xml"
+	requestsBefore := getHistogramCount(t, octopusRequestDuration, "1", reportingEndpoint, "200")
+	queriesBefore := getHistogramCount(t, queryDataDuration, "1", "table")
+	framesBefore := getHistogramCount(t, queryFrameDuration, "1", "table")
+	missesBefore := testutil.ToFloat64(reportingCacheRequests.WithLabelValues("1", "miss"))
+	keptBefore := testutil.ToFloat64(reportingRecordsParsed.WithLabelValues("1", "kept"))
+	discardedBefore := testutil.ToFloat64(reportingRecordsParsed.WithLabelValues("1", "discarded"))
+
+	_, err := newDatasource().QueryDataHandler.QueryData(context.Background(), newFakeQueryDataRequest(newFakePluginContext(server.URL, fakeApiKey), `{"format": "table", "spaceName": "Default", "TaskState": "Success"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if requests := getHistogramCount(t, octopusRequestDuration, "1", reportingEndpoint, "200") - requestsBefore; requests == 0 {
+		t.Error("expected the reporting requests to be recorded")
+	}
+
+	if queries := getHistogramCount(t, queryDataDuration, "1", "table") - queriesBefore; queries != 1 {
+		t.Errorf("expected one table query to be recorded, got %d", queries)
+	}
+
+	if frames := getHistogramCount(t, queryFrameDuration, "1", "table") - framesBefore; frames != 1 {
+		t.Errorf("expected one table frame to be recorded, got %d", frames)
+	}
+
+	if misses := testutil.ToFloat64(reportingCacheRequests.WithLabelValues("1", "miss")) - missesBefore; misses != 1 {
+		t.Errorf("expected one reporting cache miss, got %v", misses)
+	}
+
+	// the fixture holds two failed deployments and two successful deployments
+	kept := testutil.ToFloat64(reportingRecordsParsed.WithLabelValues("1", "kept")) - keptBefore
+	discarded := testutil.ToFloat64(reportingRecordsParsed.WithLabelValues("1", "discarded")) - discardedBefore
+	if kept != 2 || discarded != 2 {
+		t.Errorf("expected 2 records to be kept and 2 discarded, got %v and %v", kept, discarded)
+	}
+}
+
+func TestCircuitBreakerTripsAreRecorded(t *testing.T) {
+	cache, err := newResponseCache(1, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.close()
+
+	before := testutil.ToFloat64(circuitBreakerTrips.WithLabelValues("1"))
+	cache.set("http://octopus/api/Spaces-1/projects/all", []byte("[]"), 0)
+	cache.set("http://octopus/api/Spaces-1/environments/all", &responseError{statusCode: 500}, 0)
+
+	if trips := testutil.ToFloat64(circuitBreakerTrips.WithLabelValues("1")) - before; trips != 1 {
+		t.Fatalf("expected one circuit breaker trip, got %v", trips)
+	}
+}
@@ -1,31 +1,408 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
-	"os"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 )
 
-func TestConnection(t *testing.T) {
-	start, _ := time.Parse("2006-01-02", "2020-01-01")
-	end, _ := time.Parse("2006-01-02", "2021-01-01")
+func hour(hour int) time.Time {
+	return time.Date(2021, 1, 1, hour, 0, 0, 0, time.UTC)
+}
+
+func TestQueryData(t *testing.T) {
+	server := newFakeOctopusServer(t)
+	defer server.Close()
 
-	request := backend.QueryDataRequest{
-		PluginContext: backend.PluginContext{
-			DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
-				JSONData:                []byte("{\"Server\": \"" + os.Getenv("SERVER") + "\"}"),
-				DecryptedSecureJSONData: map[string]string{"apiKey": os.Getenv("APIKEY")},
+	tests := []struct {
+		name  string
+		query string
+		// the expected values of each field, in order
+		fields map[string][]interface{}
+		// the expected values of each field where the order is not defined
+		unorderedFields map[string][]string
+		// the expected values of each field in the timeseries buckets, which are zero in any bucket not listed
+		buckets map[time.Time]map[string]uint32
+	}{
+		{
+			name:  "table",
+			query: `{"format": "table", "spaceName": "Default", "projectName": "Web"}`,
+			fields: map[string][]interface{}{
+				"time":            {hour(10), hour(12), hour(13)},
+				"deploymentid":    {"Deployments-1", "Deployments-3", "Deployments-4"},
+				"projectname":     {"Web", "Web", "Web"},
+				"environmentname": {"Test", "Production", "Production"},
+				"releaseversion":  {"1.0.0", "1.0.0", "1.0.0"},
+				"taskstate":       {"Success", "Failed", "Success"},
+				"deployedby":      {"alice", "alice", "bob"},
+				"duration":        {uint32(300), uint32(60), uint32(180)},
+				"timeToRecovery":  {uint32(0), uint32(60), uint32(0)},
+			},
+		},
+		{
+			name:  "table filtered on the client",
+			query: `{"format": "table", "spaceName": "Default", "TaskState": "Failed"}`,
+			fields: map[string][]interface{}{
+				"deploymentid":   {"Deployments-2", "Deployments-3"},
+				"projectname":    {"Database", "Web"},
+				"timeToRecovery": {uint32(0), uint32(60)},
+			},
+		},
+		{
+			name:  "table filtered by a list and a negation",
+			query: `{"format": "table", "spaceName": "Default", "projectName": "{Web,Database}", "TaskState": "!Success"}`,
+			fields: map[string][]interface{}{
+				"deploymentid": {"Deployments-2", "Deployments-3"},
+			},
+		},
+		{
+			name:  "table filtered by a regular expression",
+			query: `{"format": "table", "spaceName": "Default", "environmentName": "/^prod/i"}`,
+			fields: map[string][]interface{}{
+				"deploymentid": {"Deployments-3", "Deployments-4"},
+			},
+		},
+		{
+			name:  "timeseries",
+			query: `{"format": "timeseries", "spaceName": "Default", "successField": true, "failureField": true, "totalDurationField": true, "totalTimeToRecoveryField": true, "totalCycleTimeField": true}`,
+			buckets: map[time.Time]map[string]uint32{
+				hour(10): {"success": 1, "failure": 0, "totalDuration": 300, "totalTimeToRecovery": 0, "totalReleaseLeadTime": 3600},
+				hour(11): {"success": 0, "failure": 1, "totalDuration": 120, "totalTimeToRecovery": 0, "totalReleaseLeadTime": 5400},
+				hour(12): {"success": 0, "failure": 1, "totalDuration": 60, "totalTimeToRecovery": 60, "totalReleaseLeadTime": 10800},
+				hour(13): {"success": 1, "failure": 0, "totalDuration": 180, "totalTimeToRecovery": 0, "totalReleaseLeadTime": 14400},
 			},
 		},
-		Queries: []backend.DataQuery{backend.DataQuery{
-			JSON: []byte("{\"format\": \"environments\", \"spaceName\": \"Octofront\", \"projectName\": \"Octofront\", \"environmentName\": \"Production\", \"averageTimeToRecoveryField\": true, \"totalCycleTimeField\": true, \"averageCycleTimeField\": true}"),
-			TimeRange: struct {
-				From time.Time
-				To   time.Time
-			}{From: start, To: end},
-		}},
+		{
+			name:  "table with the All value",
+			query: `{"format": "table", "spaceName": "Default", "projectName": "$__all", "TaskState": "Failed"}`,
+			fields: map[string][]interface{}{
+				"deploymentid": {"Deployments-2", "Deployments-3"},
+			},
+		},
+		{
+			name:  "timeseries in 6 hour buckets",
+			query: `{"format": "timeseries", "spaceName": "Default", "bucketInterval": "6h", "successField": true, "failureField": true}`,
+			buckets: map[time.Time]map[string]uint32{
+				hour(12): {"success": 2, "failure": 2},
+			},
+		},
+		{
+			name:  "timeseries for a project",
+			query: `{"format": "timeseries", "spaceName": "Default", "projectName": "Database", "successField": true, "failureField": true}`,
+			buckets: map[time.Time]map[string]uint32{
+				hour(11): {"success": 0, "failure": 1},
+			},
+		},
+		{
+			name:            "environments",
+			query:           `{"format": "environments", "spaceName": "Default"}`,
+			unorderedFields: map[string][]string{"environments": {"Production", "Test"}},
+		},
+		{
+			name:            "releases",
+			query:           `{"format": "releases", "spaceName": "Default"}`,
+			unorderedFields: map[string][]string{"releases": {"1.0.0", "1.0.1"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, err := newDatasource().QueryDataHandler.QueryData(context.Background(), newFakeQueryDataRequest(newFakePluginContext(server.URL, fakeApiKey), test.query))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			frames := response.Responses["A"].Frames
+			if len(frames) != 1 {
+				t.Fatalf("expected one frame, got %d", len(frames))
+			}
+
+			for name, expected := range test.fields {
+				field := getField(t, frames[0], name)
+				actual := []interface{}{}
+				for i := 0; i < field.Len(); i++ {
+					actual = append(actual, field.At(i))
+				}
+
+				if !reflect.DeepEqual(actual, expected) {
+					t.Errorf("expected %s to be %v, got %v", name, expected, actual)
+				}
+			}
+
+			for name, expected := range test.unorderedFields {
+				field := getField(t, frames[0], name)
+				actual := []string{}
+				for i := 0; i < field.Len(); i++ {
+					actual = append(actual, field.At(i).(string))
+				}
+				sort.Strings(actual)
+
+				if !reflect.DeepEqual(actual, expected) {
+					t.Errorf("expected %s to be %v, got %v", name, expected, actual)
+				}
+			}
+
+			if test.buckets != nil {
+				times := getField(t, frames[0], "time")
+				if times.Len() == 0 {
+					t.Fatal("expected the timeseries to have buckets")
+				}
+
+				names := map[string]bool{}
+				for _, values := range test.buckets {
+					for name := range values {
+						names[name] = true
+					}
+				}
+
+				for i := 0; i < times.Len(); i++ {
+					bucket := times.At(i).(time.Time)
+					for name := range names {
+						actual := getField(t, frames[0], name).At(i).(uint32)
+						if expected := test.buckets[bucket][name]; actual != expected {
+							t.Errorf("expected %s to be %d at %s, got %d", name, expected, bucket, actual)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestQueryDataInvalidApiKey(t *testing.T) {
+	server := newFakeOctopusServer(t)
+	defer server.Close()
+
+	response, err := newDatasource().QueryDataHandler.QueryData(context.Background(), newFakeQueryDataRequest(newFakePluginContext(server.URL, "API-WRONG"), `{"format": "table", "spaceName": "Default"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "Failed to get the spaces: 401 from Octopus: the API key is invalid"
+	if err := response.Responses["A"].Error; err == nil || err.Error() != expected {
+		t.Fatalf("expected the query to fail with %q, got %v", expected, err)
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	server := newFakeOctopusServer(t)
+	defer server.Close()
+
+	stopped := newFakeOctopusServer(t)
+	stopped.Close()
+
+	tests := []struct {
+		name            string
+		server          string
+		apiKey          string
+		expected        backend.HealthStatus
+		expectedMessage string
+	}{
+		{"working", server.URL, fakeApiKey, backend.HealthStatusOk, "Connected to Octopus 2020.5.2 as grafana. The reporting endpoint can be read in 2 spaces, which have all the required permissions"},
+		{"invalid API key", server.URL, "API-WRONG", backend.HealthStatusError, "Failed to contact Octopus server, or API key is invalid: 401 from Octopus: the API key is invalid"},
+		{"unreachable server", stopped.URL, fakeApiKey, backend.HealthStatusError, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := newDatasource().CheckHealthHandler.CheckHealth(context.Background(), &backend.CheckHealthRequest{
+				PluginContext: newFakePluginContext(test.server, test.apiKey),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result.Status != test.expected {
+				t.Fatalf("expected status %v, got %v: %s", test.expected, result.Status, result.Message)
+			}
+
+			if !empty(test.expectedMessage) && result.Message != test.expectedMessage {
+				t.Fatalf("expected the message %q, got %q", test.expectedMessage, result.Message)
+			}
+		})
+	}
+}
+
+func TestResourceRoutes(t *testing.T) {
+	server := newFakeOctopusServer(t)
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		query  string
+		// the expected JSON response
+		expected string
+		// the expected ids of the deployments in the response, for the routes returning deployments
+		expectedIds []string
+	}{
+		{name: "spaces", path: "spaces/nameid", expected: `{"Default": "Spaces-1", " ": "Spaces-1", "Operations": "Spaces-2"}`},
+		{name: "projects", path: "Spaces-1/nameid/projects", expected: `{"Web": "Projects-1", "Database": "Projects-2"}`},
+		{name: "environments", path: "Spaces-1/nameid/environments", expected: `{"Test": "Environments-1", "Production": "Environments-2"}`},
+		{name: "releases", path: "Spaces-1/nameid/releases", expected: `{"1.0.0": "Releases-1", "1.0.1": "Releases-2"}`},
+		{name: "empty space", path: "Spaces-2/nameid/projects", expected: `{}`},
+		{name: "deployments", path: "Spaces-1/deployments", query: "take=2", expectedIds: []string{"Deployments-3", "Deployments-2"}},
+		{name: "deployments created before", path: "Spaces-1/deployments", query: "toCreated=2021-01-01+11:00:00", expectedIds: []string{"Deployments-2", "Deployments-1"}},
+		{name: "reporting", path: "Spaces-1/reporting/deployments", query: "projectId=Projects-1&fromCompletedTime=2021-01-01+00:00:00&toCompletedTime=2021-01-02+00:00:00", expectedIds: []string{"Deployments-1", "Deployments-3", "Deployments-4"}},
+		{name: "reporting range", path: "Spaces-1/reporting/deployments", query: "fromCompletedTime=2021-01-01+10:30:00&toCompletedTime=2021-01-01+11:30:00", expectedIds: []string{"Deployments-2"}},
+		{name: "cache stats", path: "cache", expected: `{"responses": {"hits": 0, "misses": 0, "entries": 0, "bytes": 0, "maxBytes": 104857600, "circuitBreakerEntries": 0}, "reporting": {"deployments": 0, "fetchedRanges": 0}}`},
+		{name: "cache purge", method: http.MethodPost, path: "cache/purge", expected: `{"responses": 0, "deployments": 0}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			method := test.method
+			if empty(method) {
+				method = http.MethodGet
+			}
+
+			url := test.path
+			if !empty(test.query) {
+				url += "?" + test.query
+			}
+
+			response := &resourceResponse{}
+			err := newDatasource().CallResourceHandler.CallResource(context.Background(), &backend.CallResourceRequest{
+				PluginContext: newFakePluginContext(server.URL, fakeApiKey),
+				Path:          test.path,
+				Method:        method,
+				URL:           url,
+			}, response)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if response.status != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", response.status, response.body)
+			}
+
+			var actual interface{}
+			err = json.Unmarshal(response.body, &actual)
+			if err != nil {
+				t.Fatalf("expected a JSON response, got %s", response.body)
+			}
+
+			if test.expectedIds != nil {
+				if ids := getDeploymentIds(t, response.body); !reflect.DeepEqual(ids, test.expectedIds) {
+					t.Fatalf("expected deployments %v, got %v", test.expectedIds, ids)
+				}
+				return
+			}
+
+			var expected interface{}
+			json.Unmarshal([]byte(test.expected), &expected)
+			if !reflect.DeepEqual(actual, expected) {
+				t.Fatalf("expected %s, got %s", test.expected, response.body)
+			}
+		})
+	}
+}
+
+func TestReportingRouteRejectsInvalidRanges(t *testing.T) {
+	server := newFakeOctopusServer(t)
+	defer server.Close()
+
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"missing start", "toCompletedTime=2021-01-02+00:00:00"},
+		{"invalid end", "fromCompletedTime=2021-01-01+00:00:00&toCompletedTime=tomorrow"},
+		{"reversed", "fromCompletedTime=2021-01-02+00:00:00&toCompletedTime=2021-01-01+00:00:00"},
+		{"too many windows", "fromCompletedTime=2001-01-01+00:00:00&toCompletedTime=2021-01-01+00:00:00"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := &resourceResponse{}
+			err := newDatasource().CallResourceHandler.CallResource(context.Background(), &backend.CallResourceRequest{
+				PluginContext: newFakePluginContext(server.URL, fakeApiKey),
+				Path:          "Spaces-1/reporting/deployments",
+				Method:        http.MethodGet,
+				URL:           "Spaces-1/reporting/deployments?" + test.query,
+			}, response)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if response.status != http.StatusBadRequest {
+				t.Fatalf("expected status 400, got %d: %s", response.status, response.body)
+			}
+		})
+	}
+}
+
+func TestResourceRoutesReturnOctopusErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/api" {
+			rw.Write([]byte(`{"Version": "2020.1.0"}`))
+			return
+		}
+
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte(`{"ErrorMessage": "You do not have permission to perform this action. Missing permission: ProjectView"}`))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		path string
+		url  string
+	}{
+		{"spaces", "spaces/nameid", "spaces/nameid"},
+		{"projects", "Spaces-1/nameid/projects", "Spaces-1/nameid/projects"},
+		{"deployments", "Spaces-1/deployments", "Spaces-1/deployments?take=2"},
+		{"reporting", "Spaces-1/reporting/deployments", "Spaces-1/reporting/deployments?fromCompletedTime=2021-01-01+00:00:00&toCompletedTime=2021-01-02+00:00:00"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := &resourceResponse{}
+			err := newDatasource().CallResourceHandler.CallResource(context.Background(), &backend.CallResourceRequest{
+				PluginContext: newFakePluginContext(server.URL, fakeApiKey),
+				Path:          test.path,
+				Method:        http.MethodGet,
+				URL:           test.url,
+			}, response)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if response.status != http.StatusForbidden || !strings.Contains(string(response.body), "403 from Octopus: missing ProjectView") {
+				t.Fatalf("expected the Octopus error, got %d: %s", response.status, response.body)
+			}
+		})
+	}
+}
+
+// getDeploymentIds returns the ids of the deployments returned by the deployments and reporting routes
+func getDeploymentIds(t *testing.T, body []byte) []string {
+	ids := []string{}
+
+	var reporting Deployments
+	if json.Unmarshal(body, &reporting) == nil && reporting.Deployments != nil {
+		for _, deployment := range reporting.Deployments {
+			ids = append(ids, deployment.DeploymentId)
+		}
+		return ids
+	}
+
+	var deployments []PlainDeployment
+	err := json.Unmarshal(body, &deployments)
+	if err != nil {
+		t.Fatalf("expected a list of deployments, got %s", body)
+	}
+
+	for _, deployment := range deployments {
+		ids = append(ids, deployment.Id)
 	}
-	datasource := SampleDatasource{}
-	datasource.QueryData(nil, &request)
+	return ids
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+// circuitBreakerError is returned in place of a request to Octopus that failed recently
+type circuitBreakerError struct {
+	url string
+	// cause is the error returned by the failed request
+	cause error
+}
+
+func (e *circuitBreakerError) Error() string {
+	return "The circuit breaker for " + e.url + " is open after the request failed with: " + e.cause.Error()
+}
+
+func (e *circuitBreakerError) Unwrap() error {
+	return e.cause
+}
+
+// missingPermissionRegex matches the permission named in the message Octopus returns with a 403 response
+var missingPermissionRegex = regexp.MustCompile(`Missing permissions?:?\s*(\w+)`)
+
+// describeError returns a message for an error that makes sense to someone looking at a panel, rather than
+// the details of the request that are written to the log.
+func describeError(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timed out waiting for Octopus"
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return "the query was cancelled"
+	}
+
+	var respErr *responseError
+	if errors.As(err, &respErr) {
+		description := strconv.Itoa(respErr.statusCode) + " from Octopus"
+		if match := missingPermissionRegex.FindStringSubmatch(respErr.message); match != nil {
+			return description + ": missing " + match[1]
+		}
+		if !empty(respErr.message) {
+			return description + ": " + respErr.message
+		}
+		if respErr.statusCode == http.StatusUnauthorized {
+			return description + ": the API key is invalid"
+		}
+		return description + ": " + http.StatusText(respErr.statusCode)
+	}
+
+	return err.Error()
+}
+
+// isNotFoundError returns true if Octopus responded with a 404
+func isNotFoundError(err error) bool {
+	var respErr *responseError
+	return errors.As(err, &respErr) && respErr.statusCode == http.StatusNotFound
+}
+
+// newQueryError returns the error reported by a query, describing the cause of the failure
+func newQueryError(message string, err error) error {
+	return errors.New(message + ": " + describeError(err))
+}
+
+// newWarning returns a notice displayed with a frame that could only be partially built
+func newWarning(text string) data.Notice {
+	return data.Notice{Severity: data.NoticeSeverityWarning, Text: text}
+}
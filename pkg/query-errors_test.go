@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestDescribeError(t *testing.T) {
+	forbidden := &responseError{url: "http://octopus/api/Spaces-1/releases/Releases-1", statusCode: http.StatusForbidden, message: "You do not have permission to perform this action. Please contact your Octopus administrator. Missing permission: ReleaseView"}
+
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{"missing permission", forbidden, "403 from Octopus: missing ReleaseView"},
+		{"circuit breaker", &circuitBreakerError{url: forbidden.url, cause: forbidden}, "403 from Octopus: missing ReleaseView"},
+		{"error message", &responseError{statusCode: http.StatusBadRequest, message: "The space does not exist"}, "400 from Octopus: The space does not exist"},
+		{"invalid API key", &responseError{statusCode: http.StatusUnauthorized}, "401 from Octopus: the API key is invalid"},
+		{"no error message", &responseError{statusCode: http.StatusInternalServerError}, "500 from Octopus: Internal Server Error"},
+		{"timeout", context.DeadlineExceeded, "timed out waiting for Octopus"},
+		{"other", errors.New("connection refused"), "connection refused"},
+	}
+
+	for _, test := range tests {
+		if actual := describeError(test.err); actual != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// valueFilter matches one field of a deployment against the filter entered in a query. The filter is a single value
+// like Production that must match exactly, a list of values like {Production,Staging} (which is how Grafana formats
+// multi-value template variables), or a regular expression between slashes like /^payments-/, with /^payments-/i
+// ignoring case. Any of these is negated by starting the filter with an exclamation mark, like !Cancelled or
+// !{Cancelled,Failed}. A value starting with one of these characters is matched exactly by escaping it with a
+// backslash, like \{Legacy} or !\/api. An empty filter matches every value.
+type valueFilter struct {
+	// values is the set of values matched by a single value or list filter
+	values map[string]bool
+	regex  *regexp.Regexp
+	negate bool
+}
+
+// parseValueFilter parses the filter entered in a query
+func parseValueFilter(filter string) (valueFilter, error) {
+	if empty(filter) {
+		return valueFilter{}, nil
+	}
+
+	result := valueFilter{}
+	if strings.HasPrefix(filter, "!") {
+		result.negate = true
+		filter = filter[1:]
+	}
+
+	if strings.HasPrefix(filter, "\\") {
+		result.values = map[string]bool{filter[1:]: true}
+		return result, nil
+	}
+
+	if len(filter) >= 2 && strings.HasPrefix(filter, "/") {
+		pattern := filter[1:]
+		if strings.HasSuffix(pattern, "/i") {
+			pattern = "(?i)" + strings.TrimSuffix(pattern, "/i")
+		} else if strings.HasSuffix(pattern, "/") {
+			pattern = strings.TrimSuffix(pattern, "/")
+		} else {
+			pattern = ""
+		}
+
+		if !empty(pattern) {
+			regex, err := regexp.Compile(pattern)
+			if err != nil {
+				return valueFilter{}, errors.New("'" + filter + "' is not a valid regular expression: " + err.Error())
+			}
+			result.regex = regex
+			return result, nil
+		}
+	}
+
+	result.values = map[string]bool{}
+	if strings.HasPrefix(filter, "{") && strings.HasSuffix(filter, "}") {
+		for _, value := range strings.Split(filter[1:len(filter)-1], ",") {
+			result.values[value] = true
+		}
+	} else {
+		result.values[filter] = true
+	}
+
+	return result, nil
+}
+
+// matches returns true if the value is included by the filter
+func (f valueFilter) matches(value string) bool {
+	if f.regex == nil && f.values == nil {
+		return true
+	}
+
+	if f.regex != nil {
+		return f.regex.MatchString(value) != f.negate
+	}
+
+	return f.values[value] != f.negate
+}
+
+// exactValue returns the value of a filter that only matches a single value, which allows Octopus to do the
+// filtering when the entity with that name is known
+func (f valueFilter) exactValue() (string, bool) {
+	if f.negate || f.regex != nil || len(f.values) != 1 {
+		return "", false
+	}
+
+	for value := range f.values {
+		return value, true
+	}
+	return "", false
+}
+
+// listedValues returns the values of a filter that only matches a list of values, in no particular order
+func (f valueFilter) listedValues() []string {
+	if f.negate || f.regex != nil {
+		return nil
+	}
+
+	values := []string{}
+	for value := range f.values {
+		values = append(values, value)
+	}
+	return values
+}
+
+// deploymentFilters are the parsed filters of a query, which are parsed once rather than for every deployment
+type deploymentFilters struct {
+	releaseVersion  valueFilter
+	projectName     valueFilter
+	channelName     valueFilter
+	tenantName      valueFilter
+	environmentName valueFilter
+	taskState       valueFilter
+}
+
+// newDeploymentFilters parses the filters of a query, returning an error that names the first invalid filter
+func newDeploymentFilters(qm *queryModel) (*deploymentFilters, error) {
+	filters := &deploymentFilters{}
+	fields := []struct {
+		name   string
+		filter string
+		parsed *valueFilter
+	}{
+		{"release version", qm.ReleaseVersion, &filters.releaseVersion},
+		{"project", qm.ProjectName, &filters.projectName},
+		{"channel", qm.ChannelName, &filters.channelName},
+		{"tenant", qm.TenantName, &filters.tenantName},
+		{"environment", qm.EnvironmentName, &filters.environmentName},
+		{"task state", qm.TaskState, &filters.taskState},
+	}
+
+	for _, field := range fields {
+		parsed, err := parseValueFilter(field.filter)
+		if err != nil {
+			return nil, errors.New("the " + field.name + " filter " + err.Error())
+		}
+		*field.parsed = parsed
+	}
+
+	return filters, nil
+}
+
+// includeRecovery returns true if the deployment is a success that could end the failures of the deployments
+// included by the filters. The time to recovery is found by scanning forward from a failure to the next success in
+// the same project, environment, tenant and channel, so that success must be kept even when the task state or
+// release version filters exclude it.
+func (f *deploymentFilters) includeRecovery(deployment *Deployment) bool {
+	return deployment.TaskState == "Success" &&
+		f.projectName.matches(deployment.ProjectName) &&
+		f.channelName.matches(deployment.ChannelName) &&
+		f.tenantName.matches(deployment.TenantName) &&
+		f.environmentName.matches(deployment.EnvironmentName)
+}
+
+// include returns true if the deployment matches every filter
+func (f *deploymentFilters) include(deployment *Deployment) bool {
+	return f.releaseVersion.matches(deployment.ReleaseVersion) &&
+		f.projectName.matches(deployment.ProjectName) &&
+		f.channelName.matches(deployment.ChannelName) &&
+		f.tenantName.matches(deployment.TenantName) &&
+		f.environmentName.matches(deployment.EnvironmentName) &&
+		f.taskState.matches(deployment.TaskState)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestValueFilterMatches(t *testing.T) {
+	tests := []struct {
+		filter    string
+		matches   []string
+		unmatched []string
+	}{
+		{"", []string{"Production", ""}, []string{}},
+		{"Production", []string{"Production"}, []string{"production", "Staging"}},
+		{"{Production,Staging}", []string{"Production", "Staging"}, []string{"Test", "{Production,Staging}"}},
+		{"/^payments-/", []string{"payments-api", "payments-web"}, []string{"Payments-api", "web-payments-api"}},
+		{"/^payments-/i", []string{"Payments-api"}, []string{"web"}},
+		{"!Cancelled", []string{"Success", "Failed"}, []string{"Cancelled"}},
+		{"!{Cancelled,TimedOut}", []string{"Success"}, []string{"Cancelled", "TimedOut"}},
+		{"!/^payments-/", []string{"web"}, []string{"payments-api"}},
+		// a name that only starts with a slash is not a regular expression
+		{"/api", []string{"/api"}, []string{"api"}},
+		// a backslash matches the rest of the filter exactly
+		{`\{Legacy}`, []string{"{Legacy}"}, []string{"Legacy", `\{Legacy}`}},
+		{`\!Important`, []string{"!Important"}, []string{"Important"}},
+		{`\/^payments-/`, []string{"/^payments-/"}, []string{"payments-api"}},
+		{`!\{Legacy}`, []string{"Legacy"}, []string{"{Legacy}"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.filter, func(t *testing.T) {
+			filter, err := parseValueFilter(test.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, value := range test.matches {
+				if !filter.matches(value) {
+					t.Errorf("expected %q to match", value)
+				}
+			}
+			for _, value := range test.unmatched {
+				if filter.matches(value) {
+					t.Errorf("expected %q not to match", value)
+				}
+			}
+		})
+	}
+}
+
+func TestValueFilterExactValue(t *testing.T) {
+	tests := []struct {
+		filter   string
+		expected string
+		exact    bool
+		listed   []string
+	}{
+		{"Web", "Web", true, []string{"Web"}},
+		{"{Web}", "Web", true, []string{"Web"}},
+		{"{Web,Database}", "", false, []string{"Database", "Web"}},
+		{"!Web", "", false, nil},
+		{"/^Web/", "", false, nil},
+		{`\{Web}`, "{Web}", true, []string{"{Web}"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.filter, func(t *testing.T) {
+			filter, err := parseValueFilter(test.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if value, exact := filter.exactValue(); value != test.expected || exact != test.exact {
+				t.Errorf("expected the exact value %q (%v), got %q (%v)", test.expected, test.exact, value, exact)
+			}
+
+			listed := filter.listedValues()
+			sort.Strings(listed)
+			if !reflect.DeepEqual(listed, test.listed) {
+				t.Errorf("expected the listed values %v, got %v", test.listed, listed)
+			}
+		})
+	}
+}
+
+func TestGetQueryModelRejectsInvalidRegex(t *testing.T) {
+	_, err := getQueryModel(backend.DataQuery{JSON: []byte(`{"projectName": "/(payments/"}`)})
+	if err == nil {
+		t.Fatal("expected the invalid regular expression to be reported")
+	}
+}
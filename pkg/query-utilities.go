@@ -3,6 +3,8 @@ package main
 import (
 	"encoding/json"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -24,39 +26,94 @@ func getQueryDetails(req *backend.QueryDataRequest) (time.Time, time.Time) {
 	return earliestDate, latestDate
 }
 
-func getQueryModel(jsonData []byte) (queryModel, error) {
+// getQueryModel parses the JSON of a query, replacing the macros that Grafana did not replace before sending it
+func getQueryModel(query backend.DataQuery) (queryModel, error) {
 	// Unmarshal the json into our queryModel
 	var qm queryModel
 
-	err := json.Unmarshal(jsonData, &qm)
+	err := json.Unmarshal(query.JSON, &qm)
+	if err != nil {
+		return qm, err
+	}
+
+	err = interpolateQueryModel(&qm, query)
+	if err != nil {
+		return qm, err
+	}
+
+	if !empty(qm.BucketInterval) {
+		qm.BucketDuration, err = parseInterval(qm.BucketInterval)
+		if err != nil {
+			return qm, err
+		}
+	}
+
+	qm.Filters, err = newDeploymentFilters(&qm)
 	return qm, err
 }
 
-// includeDeployment will determine if a deployment record satisfies the current filters
-func includeDeployment(qm *queryModel, deployment *Deployment) bool {
-	if !empty(qm.ReleaseVersion) && deployment.ReleaseVersion != qm.ReleaseVersion {
-		return false
+// getDeploymentFilters returns the parsed filters of a query. A query that was not built by getQueryModel has
+// its filters parsed now, and a filter that can not be parsed matches nothing.
+func getDeploymentFilters(qm *queryModel) *deploymentFilters {
+	if qm.Filters != nil {
+		return qm.Filters
 	}
 
-	if !empty(qm.ProjectName) && deployment.ProjectName != qm.ProjectName {
-		return false
+	filters, err := newDeploymentFilters(qm)
+	if err != nil {
+		return nil
 	}
+	return filters
+}
+
+// includeDeployment will determine if a deployment record satisfies the current filters
+func includeDeployment(qm *queryModel, deployment *Deployment) bool {
+	filters := getDeploymentFilters(qm)
+	return filters != nil && filters.include(deployment)
+}
 
-	if !empty(qm.ChannelName) && deployment.ChannelName != qm.ChannelName {
-		return false
+// reportingFilter holds the queries that share a reporting endpoint request. A deployment is included if
+// any of the queries include it, or if it could be the recovery of a failed deployment the queries include.
+// An empty filter includes every deployment.
+type reportingFilter []*queryModel
+
+func (f reportingFilter) include(deployment *Deployment) bool {
+	if len(f) == 0 {
+		return true
 	}
 
-	if !empty(qm.TenantName) && deployment.TenantName != qm.TenantName {
-		return false
+	for _, qm := range f {
+		filters := getDeploymentFilters(qm)
+		if filters != nil && (filters.include(deployment) || filters.includeRecovery(deployment)) {
+			return true
+		}
 	}
 
-	if !empty(qm.EnvironmentName) && deployment.EnvironmentName != qm.EnvironmentName {
-		return false
+	return false
+}
+
+// key identifies the deployments included by the filter. It is empty when every deployment is included.
+func (f reportingFilter) key() string {
+	filters := []string{}
+	for _, qm := range f {
+		fields := []string{qm.ReleaseVersion, qm.ProjectName, qm.ChannelName, qm.TenantName, qm.EnvironmentName, qm.TaskState}
+		if empty(strings.Join(fields, "")) {
+			// this query includes everything, so the other queries make no difference
+			return ""
+		}
+
+		filter, _ := json.Marshal(fields)
+		filters = append(filters, string(filter))
 	}
 
-	if !empty(qm.TaskState) && deployment.TaskState != qm.TaskState {
-		return false
+	sort.Strings(filters)
+
+	unique := []string{}
+	for i, filter := range filters {
+		if i == 0 || filter != filters[i-1] {
+			unique = append(unique, filter)
+		}
 	}
 
-	return true
+	return strings.Join(unique, ",")
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tokenBucket limits the rate of requests. Tokens are added at rate per second, up to burst, and each request
+// takes one. Requests arriving when the bucket is empty reserve the next token, so they are served in order.
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// wait blocks until a token is available, or returns the error of the context if it is done first
+func (b *tokenBucket) wait(ctx context.Context) error {
+	b.mutex.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	// take the token now, even if it is yet to be added, so later requests wait behind this one
+	b.tokens--
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mutex.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// give back the token, as the request will not be made
+		b.mutex.Lock()
+		b.tokens++
+		b.mutex.Unlock()
+		return ctx.Err()
+	}
+}
+
+// limitTransport limits the requests a datasource makes to Octopus, both in rate and in the number waiting on
+// a response at once. A request holds its slot until the response body is closed, so streamed responses count
+// for as long as they are being read. Waiting requests give up as soon as their context is done.
+type limitTransport struct {
+	// bucket is nil if the rate is not limited
+	bucket *tokenBucket
+	// slots is nil if the number of requests in flight is not limited
+	slots chan struct{}
+	base  http.RoundTripper
+}
+
+func newLimitTransport(rate float64, burst int, maxInFlight int, base http.RoundTripper) *limitTransport {
+	transport := &limitTransport{base: base}
+	if rate > 0 {
+		transport.bucket = newTokenBucket(rate, burst)
+	}
+	if maxInFlight > 0 {
+		transport.slots = make(chan struct{}, maxInFlight)
+	}
+	return transport
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	if t.bucket != nil {
+		if err := t.bucket.wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if t.slots == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	select {
+	case t.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	release := func() { <-t.slots }
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+func (t *limitTransport) CloseIdleConnections() {
+	if closer, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// releasingBody frees the slot of a request once its response body is closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
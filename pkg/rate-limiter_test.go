@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketLimitsRate(t *testing.T) {
+	bucket := newTokenBucket(50, 2)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := bucket.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the burst of 2 is immediate, and the other 3 requests wait 20ms each
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("expected the requests to be limited to 50 per second, but 5 took %s", elapsed)
+	}
+}
+
+func TestTokenBucketHonoursCancellation(t *testing.T) {
+	bucket := newTokenBucket(0.01, 1)
+	if err := bucket.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := bucket.wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the wait to end with the context, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the wait to end when the context was done, but it took %s", elapsed)
+	}
+}
+
+func TestLimitTransportLimitsRequestsInFlight(t *testing.T) {
+	var mutex sync.Mutex
+	inFlight := 0
+	maxInFlight := 0
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mutex.Unlock()
+
+		<-release
+
+		mutex.Lock()
+		inFlight--
+		mutex.Unlock()
+		rw.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: newLimitTransport(0, 0, 2, http.DefaultTransport)}
+
+	var wait sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if _, err := defaultRetryPolicy.sendRequest(context.Background(), client, server.URL, ""); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	// a request waiting for a slot gives up when its context is done
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := defaultRetryPolicy.sendRequest(ctx, client, server.URL, ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the waiting request to end with the context, got %v", err)
+	}
+
+	close(release)
+	wait.Wait()
+
+	if maxInFlight != 2 {
+		t.Fatalf("expected at most 2 requests in flight, got %d", maxInFlight)
+	}
+}
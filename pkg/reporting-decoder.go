@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+)
+
+// stringInterner returns a single copy of equal strings. The reporting endpoint repeats the same project,
+// environment, channel and tenant details in every deployment, so sharing them keeps the records compact.
+type stringInterner map[string]string
+
+func (i stringInterner) intern(value string) string {
+	if interned, ok := i[value]; ok {
+		return interned
+	}
+	i[value] = value
+	return value
+}
+
+// decodeDeployments reads the deployments in a reporting endpoint response one element at a time, so the
+// whole response is never held in memory. Deployments the filter does not include are discarded as they
+// are read, and the rest are parsed into compact records and passed to add. The number of deployments read,
+// including those that were discarded, is returned.
+func decodeDeployments(body io.Reader, filter reportingFilter, add func(Deployment)) (int, error) {
+	decoder := xml.NewDecoder(body)
+	interner := stringInterner{}
+	parsed := 0
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return parsed, nil
+		}
+		if err != nil {
+			return parsed, err
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "Deployment" {
+			continue
+		}
+
+		deployment := Deployment{}
+		err = decoder.DecodeElement(&deployment, &start)
+		if err != nil {
+			return parsed, err
+		}
+		parsed++
+
+		if !filter.include(&deployment) {
+			continue
+		}
+
+		compactDeployment(&deployment, interner)
+		add(deployment)
+	}
+}
+
+// compactDeployment parses the deployment times and shares the strings that are repeated between deployments
+func compactDeployment(deployment *Deployment, interner stringInterner) {
+	deployment.XMLName = xml.Name{}
+	parseDeploymentTimes(deployment)
+
+	deployment.ProjectId = interner.intern(deployment.ProjectId)
+	deployment.ProjectName = interner.intern(deployment.ProjectName)
+	deployment.ProjectSlug = interner.intern(deployment.ProjectSlug)
+	deployment.TenantId = interner.intern(deployment.TenantId)
+	deployment.TenantName = interner.intern(deployment.TenantName)
+	deployment.ChannelId = interner.intern(deployment.ChannelId)
+	deployment.ChannelName = interner.intern(deployment.ChannelName)
+	deployment.EnvironmentId = interner.intern(deployment.EnvironmentId)
+	deployment.EnvironmentName = interner.intern(deployment.EnvironmentName)
+	deployment.ReleaseId = interner.intern(deployment.ReleaseId)
+	deployment.ReleaseVersion = interner.intern(deployment.ReleaseVersion)
+	deployment.TaskState = interner.intern(deployment.TaskState)
+	deployment.DeployedBy = interner.intern(deployment.DeployedBy)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+const reportingResponse = `<?xml version="1.0" encoding="utf-8"?>
+<Deployments>
+  <Deployment>
+    <DeploymentId>Deployments-1</DeploymentId>
+    <ProjectName>Web</ProjectName>
+    <EnvironmentName>Production</EnvironmentName>
+    <TaskState>Success</TaskState>
+    <StartTime>2021-01-01T10:00:00</StartTime>
+    <CompletedTime>2021-01-01T10:05:00</CompletedTime>
+  </Deployment>
+  <Deployment>
+    <DeploymentId>Deployments-2</DeploymentId>
+    <ProjectName>Database</ProjectName>
+    <EnvironmentName>Production</EnvironmentName>
+    <TaskState>Failed</TaskState>
+    <CompletedTime>2021-01-01T11:00:00</CompletedTime>
+  </Deployment>
+  <Deployment>
+    <DeploymentId>Deployments-3</DeploymentId>
+    <ProjectName>Web</ProjectName>
+    <EnvironmentName>Test</EnvironmentName>
+    <TaskState>Failed</TaskState>
+    <CompletedTime>2021-01-01T12:00:00</CompletedTime>
+  </Deployment>
+</Deployments>`
+
+func decodeTestDeployments(t *testing.T, filter reportingFilter) []Deployment {
+	deployments := []Deployment{}
+	_, err := decodeDeployments(strings.NewReader(reportingResponse), filter, func(deployment Deployment) {
+		deployments = append(deployments, deployment)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deployments
+}
+
+func TestDecodeDeployments(t *testing.T) {
+	deployments := decodeTestDeployments(t, nil)
+
+	if len(deployments) != 3 {
+		t.Fatalf("expected 3 deployments, got %d", len(deployments))
+	}
+
+	if !deployments[0].StartTimeParsed.Equal(time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)) ||
+		!deployments[0].CompletedTimeParsed.Equal(time.Date(2021, 1, 1, 10, 5, 0, 0, time.UTC)) {
+		t.Fatalf("expected the times to be parsed, got %v", deployments[0])
+	}
+}
+
+func TestDecodeDeploymentsFilters(t *testing.T) {
+	tests := []struct {
+		name     string
+		filter   reportingFilter
+		expected []string
+	}{
+		{"project", reportingFilter{{ProjectName: "Web"}}, []string{"Deployments-1", "Deployments-3"}},
+		{"project and state", reportingFilter{{ProjectName: "Database", TaskState: "Failed"}}, []string{"Deployments-2"}},
+		{"recovery", reportingFilter{{ProjectName: "Web", TaskState: "Failed"}}, []string{"Deployments-1", "Deployments-3"}},
+		{"any query", reportingFilter{{ProjectName: "Database"}, {EnvironmentName: "Test"}}, []string{"Deployments-2", "Deployments-3"}},
+		{"unfiltered query", reportingFilter{{ProjectName: "Database"}, {}}, []string{"Deployments-1", "Deployments-2", "Deployments-3"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ids := []string{}
+			for _, deployment := range decodeTestDeployments(t, test.filter) {
+				ids = append(ids, deployment.DeploymentId)
+			}
+
+			if strings.Join(ids, ",") != strings.Join(test.expected, ",") {
+				t.Fatalf("expected %v, got %v", test.expected, ids)
+			}
+		})
+	}
+}
+
+const recoveryResponse = `<?xml version="1.0" encoding="utf-8"?>
+<Deployments>
+  <Deployment>
+    <DeploymentId>Deployments-1</DeploymentId>
+    <ProjectId>Projects-1</ProjectId>
+    <EnvironmentId>Environments-1</EnvironmentId>
+    <ChannelId>Channels-1</ChannelId>
+    <ReleaseVersion>1.0.0</ReleaseVersion>
+    <TaskState>Failed</TaskState>
+    <CompletedTime>2021-01-01T10:00:00</CompletedTime>
+  </Deployment>
+  <Deployment>
+    <DeploymentId>Deployments-2</DeploymentId>
+    <ProjectId>Projects-1</ProjectId>
+    <EnvironmentId>Environments-1</EnvironmentId>
+    <ChannelId>Channels-1</ChannelId>
+    <ReleaseVersion>1.0.1</ReleaseVersion>
+    <TaskState>Success</TaskState>
+    <CompletedTime>2021-01-01T10:30:00</CompletedTime>
+  </Deployment>
+</Deployments>`
+
+func TestDecodeDeploymentsKeepsRecoveries(t *testing.T) {
+	tests := []struct {
+		name string
+		qm   queryModel
+	}{
+		{"task state", queryModel{TaskState: "Failed"}},
+		{"release version", queryModel{ReleaseVersion: "1.0.0"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deployments := Deployments{}
+			_, err := decodeDeployments(strings.NewReader(recoveryResponse), reportingFilter{&test.qm}, func(deployment Deployment) {
+				deployments.Deployments = append(deployments.Deployments, deployment)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			frame := (&SampleDatasource{}).queryTable(context.Background(), test.qm, deployments).Frames[0]
+			ids := getField(t, frame, "deploymentid")
+			if ids.Len() != 1 || ids.At(0).(string) != "Deployments-1" {
+				t.Fatalf("expected only the failed deployment to be returned, got %d deployments", ids.Len())
+			}
+
+			if recovery := getField(t, frame, "timeToRecovery").At(0).(uint32); recovery != 30 {
+				t.Fatalf("expected the failed deployment to recover in 30 minutes, got %d", recovery)
+			}
+		})
+	}
+}
+
+func TestDecodeDeploymentsInvalidXml(t *testing.T) {
+	_, err := decodeDeployments(strings.NewReader("<Deployments><Deployment><DeploymentId>"), nil, func(Deployment) {})
+	if err == nil {
+		t.Fatal("expected an error for a truncated response")
+	}
+}
+
+func TestReportingFilterKey(t *testing.T) {
+	if key := (reportingFilter{{ProjectName: "Web"}, {}}).key(); key != "" {
+		t.Fatalf("expected a filter with an unfiltered query to have an empty key, got %s", key)
+	}
+
+	first := reportingFilter{{ProjectName: "Web"}, {TaskState: "Failed"}, {ProjectName: "Web"}}.key()
+	second := reportingFilter{{TaskState: "Failed"}, {ProjectName: "Web"}}.key()
+	if empty(first) || first != second {
+		t.Fatalf("expected the key to ignore the order and duplicates of the queries, got %s and %s", first, second)
+	}
+}
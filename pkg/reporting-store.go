@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reportingSettleTime is how long we wait after a deployment completes before assuming the reporting endpoint
+// includes it. Time ranges more recent than this are never marked as fetched, so they are requested again.
+const reportingSettleTime = 5 * time.Minute
+
+// reportingWindow is the length of the aligned time windows the reporting endpoint is queried with. Long ranges
+// are split into windows that are fetched concurrently, and the windows that have closed are never fetched again.
+// Windows are truncated from the zero time, which was a Monday, so each window is a calendar week in UTC.
+const reportingWindow = 7 * 24 * time.Hour
+
+// maxReportingWindows limits a reporting range to about ten years of windows. A wider range is almost certainly a
+// mistake, like a missing start date, and would send thousands of requests to Octopus.
+const maxReportingWindows = 520
+
+// reportingSaveInterval is how long the reporting store waits after deployments are added before saving them to
+// disk, so the many windows added by a query are saved together
+const reportingSaveInterval = 30 * time.Second
+
+// maxReportingDeployments bounds the deployments held by the reporting store of a datasource, which are not counted
+// in the cache size. Once there are more, the deployments that completed first are removed, and their time ranges
+// are requested from Octopus again if they are queried.
+const maxReportingDeployments = 100000
+
+// timeRange is a range of deployment completion times
+type timeRange struct {
+	From time.Time
+	To   time.Time
+}
+
+// reportingStoreData is the content of the reporting store file
+type reportingStoreData struct {
+	// Deployments maps space ids to deployment ids to the deployment records
+	Deployments map[string]map[string]Deployment
+	// Fetched maps a reporting filter, as returned by reportingFilterKey, to the time ranges requested from Octopus
+	Fetched map[string][]timeRange
+}
+
+// reportingStore is a thread safe cache of the deployments returned by the reporting endpoint, along with the time
+// ranges that were requested to get them for each space, project and environment filter. This means only the time
+// ranges that have not been requested before need to be downloaded from Octopus. When the store has a path, it is
+// also saved to a file so the deployment history survives plugin restarts. Changes are saved on a timer, and
+// when the store is closed.
+type reportingStore struct {
+	path  string
+	mutex sync.Mutex
+	data  reportingStoreData
+	// maxDeployments is the number of deployments held before the oldest are removed
+	maxDeployments int
+	// dirty is true if the data has changed since it was last saved
+	dirty bool
+	// saveTimer is the pending save, or nil if no save is scheduled
+	saveTimer *time.Timer
+	closed    bool
+	// saveMutex stops two saves from writing the file at once, without holding mutex while writing
+	saveMutex sync.Mutex
+}
+
+// getReportingStorePath returns the file used to store the reporting deployments of a datasource instance. The
+// file name includes a hash of the server and API key, so records fetched with one API key are not read with
+// another, while changing any other setting keeps the same file.
+func getReportingStorePath(directory string, datasourceId int64, server string, apiKey string) (string, error) {
+	if empty(directory) {
+		executable, err := os.Executable()
+		if err != nil {
+			return "", err
+		}
+		directory = filepath.Join(filepath.Dir(executable), "data")
+	}
+
+	hash := sha256.Sum256([]byte(server + "\n" + apiKey))
+	return filepath.Join(directory, getReportingStorePrefix(datasourceId)+hex.EncodeToString(hash[:])[:16]+".gob"), nil
+}
+
+// getReportingStorePrefix returns the start of the names of the reporting store files of a datasource
+func getReportingStorePrefix(datasourceId int64) string {
+	return "reporting-" + strconv.FormatInt(datasourceId, 10) + "-"
+}
+
+// removeStaleReportingStores deletes the files saved by a datasource for a server or API key it no longer uses
+func removeStaleReportingStores(path string, datasourceId int64) {
+	files, err := filepath.Glob(filepath.Join(filepath.Dir(path), getReportingStorePrefix(datasourceId)+"*.gob"))
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		if file == path {
+			continue
+		}
+
+		err := os.Remove(file)
+		if err != nil {
+			log.DefaultLogger.Error("Failed to remove the stale reporting store " + file + ": " + err.Error())
+		} else {
+			log.DefaultLogger.Info("Removed the stale reporting store " + file)
+		}
+	}
+}
+
+// openReportingStore loads the reporting store from the file at path. A missing or unreadable
+// file results in an empty store, and an empty path results in a store that is only held in memory.
+func openReportingStore(path string) *reportingStore {
+	store := &reportingStore{
+		path:           path,
+		maxDeployments: maxReportingDeployments,
+		data: reportingStoreData{
+			Deployments: map[string]map[string]Deployment{},
+			Fetched:     map[string][]timeRange{},
+		},
+	}
+
+	if empty(path) {
+		return store
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.DefaultLogger.Error("Failed to open the reporting store " + path + ": " + err.Error())
+		}
+		return store
+	}
+	defer file.Close()
+
+	var data reportingStoreData
+	err = gob.NewDecoder(file).Decode(&data)
+	if err != nil || data.Deployments == nil || data.Fetched == nil {
+		log.DefaultLogger.Error("Ignoring the unreadable reporting store " + path)
+		return store
+	}
+
+	store.data = data
+	store.trim()
+	return store
+}
+
+// reportingFilterKey identifies the server side filters applied to a reporting endpoint request, along with
+// the key of the reportingFilter applied to the deployments as they were read
+func reportingFilterKey(spaceId string, projectId string, environmentId string, filterKey string) string {
+	return spaceId + "/" + projectId + "/" + environmentId + "/" + filterKey
+}
+
+// missingRanges returns the parts of the time range that have not been fetched for the filters. Ranges fetched
+// without a reportingFilter, or for the whole space, include every deployment the filters do, so they also
+// count as fetched.
+func (s *reportingStore) missingRanges(spaceId string, projectId string, environmentId string, filterKey string, from time.Time, to time.Time) []timeRange {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	fetched := s.data.Fetched[reportingFilterKey(spaceId, projectId, environmentId, filterKey)]
+	for _, key := range []string{reportingFilterKey(spaceId, projectId, environmentId, ""), reportingFilterKey(spaceId, "", "", "")} {
+		for _, unfilteredRange := range s.data.Fetched[key] {
+			fetched = mergeTimeRange(fetched, unfilteredRange)
+		}
+	}
+
+	return subtractTimeRanges(timeRange{From: from, To: to}, fetched)
+}
+
+// add stores the deployments returned for the fetched time ranges, and schedules a save if the store has a path
+func (s *reportingStore) add(spaceId string, projectId string, environmentId string, filterKey string, fetched []timeRange, deployments []Deployment) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.data.Deployments[spaceId]; !ok {
+		s.data.Deployments[spaceId] = map[string]Deployment{}
+	}
+
+	for _, deployment := range deployments {
+		s.data.Deployments[spaceId][deployment.DeploymentId] = deployment
+	}
+
+	// Deployments that completed very recently may not be reported yet, so that time is fetched again next time
+	settled := time.Now().UTC().Add(-reportingSettleTime)
+	key := reportingFilterKey(spaceId, projectId, environmentId, filterKey)
+	for _, fetchedRange := range fetched {
+		if fetchedRange.To.After(settled) {
+			fetchedRange.To = settled
+		}
+
+		if fetchedRange.To.After(fetchedRange.From) {
+			s.data.Fetched[key] = mergeTimeRange(s.data.Fetched[key], fetchedRange)
+		}
+	}
+
+	s.trim()
+	s.scheduleSave()
+}
+
+// trim removes the deployments that completed first until no more than maxDeployments remain. The fetched time
+// ranges are cut to start after the removed deployments, so the removed time is requested again if it is queried.
+// The caller must hold the mutex.
+func (s *reportingStore) trim() {
+	completed := []time.Time{}
+	for _, deployments := range s.data.Deployments {
+		for _, deployment := range deployments {
+			completed = append(completed, deployment.CompletedTimeParsed)
+		}
+	}
+
+	excess := len(completed) - s.maxDeployments
+	if excess <= 0 {
+		return
+	}
+
+	// everything that completed at or before the cutoff is removed, which is more than excess if several
+	// deployments completed at the cutoff
+	sort.Slice(completed, func(i, j int) bool { return completed[i].Before(completed[j]) })
+	cutoff := completed[excess-1]
+
+	for spaceId, deployments := range s.data.Deployments {
+		for id, deployment := range deployments {
+			if !deployment.CompletedTimeParsed.After(cutoff) {
+				delete(deployments, id)
+			}
+		}
+		if len(deployments) == 0 {
+			delete(s.data.Deployments, spaceId)
+		}
+	}
+
+	retainedFrom := cutoff.Add(time.Nanosecond)
+	for key, ranges := range s.data.Fetched {
+		trimmed := []timeRange{}
+		for _, fetchedRange := range ranges {
+			if fetchedRange.From.Before(retainedFrom) {
+				fetchedRange.From = retainedFrom
+			}
+			if fetchedRange.To.After(fetchedRange.From) {
+				trimmed = append(trimmed, fetchedRange)
+			}
+		}
+
+		if len(trimmed) == 0 {
+			delete(s.data.Fetched, key)
+		} else {
+			s.data.Fetched[key] = trimmed
+		}
+	}
+
+	s.dirty = true
+	log.DefaultLogger.Info("Removed the reporting deployments that completed before " + retainedFrom.Format(time.RFC3339) + " to keep the reporting store under " + strconv.Itoa(s.maxDeployments) + " deployments")
+}
+
+// deployments returns the stored deployments matching the server side filters that completed in the time range,
+// ordered by completion time. The deployments may include some that a reportingFilter used to fetch them does not.
+func (s *reportingStore) deployments(spaceId string, projectId string, environmentId string, from time.Time, to time.Time) []Deployment {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	results := []Deployment{}
+	for _, deployment := range s.data.Deployments[spaceId] {
+		if !empty(projectId) && deployment.ProjectId != projectId {
+			continue
+		}
+
+		if !empty(environmentId) && deployment.EnvironmentId != environmentId {
+			continue
+		}
+
+		if deployment.CompletedTimeParsed.Before(from) || deployment.CompletedTimeParsed.After(to) {
+			continue
+		}
+
+		results = append(results, deployment)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].CompletedTimeParsed.Equal(results[j].CompletedTimeParsed) {
+			return results[i].DeploymentId < results[j].DeploymentId
+		}
+		return results[i].CompletedTimeParsed.Before(results[j].CompletedTimeParsed)
+	})
+
+	return results
+}
+
+// reportingStoreStats summarises the contents of a reporting store
+type reportingStoreStats struct {
+	Deployments   int `json:"deployments"`
+	FetchedRanges int `json:"fetchedRanges"`
+}
+
+// stats returns the number of deployments and fetched time ranges held by the store
+func (s *reportingStore) stats() reportingStoreStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stats := reportingStoreStats{}
+	for _, deployments := range s.data.Deployments {
+		stats.Deployments += len(deployments)
+	}
+	for _, ranges := range s.data.Fetched {
+		stats.FetchedRanges += len(ranges)
+	}
+	return stats
+}
+
+// purge removes the deployments and fetched time ranges of a space, or of every space if spaceId is empty,
+// returning the number of deployments removed
+func (s *reportingStore) purge(spaceId string) int {
+	s.mutex.Lock()
+
+	purged := 0
+	for space, deployments := range s.data.Deployments {
+		if empty(spaceId) || space == spaceId {
+			purged += len(deployments)
+			delete(s.data.Deployments, space)
+		}
+	}
+
+	for key := range s.data.Fetched {
+		if empty(spaceId) || strings.HasPrefix(key, spaceId+"/") {
+			delete(s.data.Fetched, key)
+		}
+	}
+
+	s.dirty = true
+	s.mutex.Unlock()
+
+	// a purge is saved straight away, so the purged deployments are not read back if the plugin restarts
+	s.flush()
+
+	return purged
+}
+
+// scheduleSave saves the store once reportingSaveInterval has passed, unless a save is already scheduled.
+// The caller must hold the mutex.
+func (s *reportingStore) scheduleSave() {
+	s.dirty = true
+	if empty(s.path) || s.closed || s.saveTimer != nil {
+		return
+	}
+
+	s.saveTimer = time.AfterFunc(reportingSaveInterval, s.flush)
+}
+
+// flush saves the store if it has changed since it was last saved
+func (s *reportingStore) flush() {
+	s.saveMutex.Lock()
+	defer s.saveMutex.Unlock()
+
+	s.mutex.Lock()
+	if s.saveTimer != nil {
+		s.saveTimer.Stop()
+		s.saveTimer = nil
+	}
+	if empty(s.path) || !s.dirty {
+		s.mutex.Unlock()
+		return
+	}
+
+	// the data is encoded while holding the mutex, but written to disk after releasing it
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(s.data)
+	s.dirty = false
+	s.mutex.Unlock()
+
+	if err == nil {
+		err = s.save(buffer.Bytes())
+	}
+	if err != nil {
+		log.DefaultLogger.Error("Failed to save the reporting store " + s.path + ": " + err.Error())
+	}
+}
+
+// close saves any changes that have not been saved yet, and stops any later changes being saved
+func (s *reportingStore) close() {
+	s.mutex.Lock()
+	s.closed = true
+	s.mutex.Unlock()
+
+	s.flush()
+}
+
+// save writes the encoded store to a temporary file that then replaces the store file, so a crash
+// never leaves a partially written store behind. The caller must hold the saveMutex.
+func (s *reportingStore) save(encoded []byte) error {
+	err := os.MkdirAll(filepath.Dir(s.path), 0750)
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(encoded)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), s.path)
+}
+
+// splitTimeRange splits a range at each multiple of the window length
+func splitTimeRange(wanted timeRange, window time.Duration) []timeRange {
+	split := []timeRange{}
+
+	for start := wanted.From; start.Before(wanted.To); {
+		end := start.Truncate(window).Add(window)
+		if end.After(wanted.To) {
+			end = wanted.To
+		}
+
+		split = append(split, timeRange{From: start, To: end})
+		start = end
+	}
+
+	return split
+}
+
+// mergeTimeRange adds a range to a sorted list of ranges, combining any ranges that overlap or touch
+func mergeTimeRange(ranges []timeRange, newRange timeRange) []timeRange {
+	merged := []timeRange{}
+	inserted := false
+
+	for _, existing := range ranges {
+		if existing.To.Before(newRange.From) {
+			merged = append(merged, existing)
+		} else if newRange.To.Before(existing.From) {
+			if !inserted {
+				merged = append(merged, newRange)
+				inserted = true
+			}
+			merged = append(merged, existing)
+		} else {
+			// the ranges overlap, so grow the new range to cover both
+			if existing.From.Before(newRange.From) {
+				newRange.From = existing.From
+			}
+			if existing.To.After(newRange.To) {
+				newRange.To = existing.To
+			}
+		}
+	}
+
+	if !inserted {
+		merged = append(merged, newRange)
+	}
+
+	return merged
+}
+
+// subtractTimeRanges returns the parts of the wanted range not covered by the sorted list of ranges
+func subtractTimeRanges(wanted timeRange, ranges []timeRange) []timeRange {
+	missing := []timeRange{}
+	start := wanted.From
+
+	for _, existing := range ranges {
+		if !existing.To.After(start) {
+			continue
+		}
+
+		if !existing.From.Before(wanted.To) {
+			break
+		}
+
+		if existing.From.After(start) {
+			missing = append(missing, timeRange{From: start, To: existing.From})
+		}
+
+		start = existing.To
+	}
+
+	if start.Before(wanted.To) {
+		missing = append(missing, timeRange{From: start, To: wanted.To})
+	}
+
+	return missing
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func hours(from int, to int) timeRange {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	return timeRange{From: start.Add(time.Duration(from) * time.Hour), To: start.Add(time.Duration(to) * time.Hour)}
+}
+
+func TestMergeTimeRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		ranges   []timeRange
+		newRange timeRange
+		expected []timeRange
+	}{
+		{"empty", []timeRange{}, hours(1, 2), []timeRange{hours(1, 2)}},
+		{"before", []timeRange{hours(3, 4)}, hours(1, 2), []timeRange{hours(1, 2), hours(3, 4)}},
+		{"after", []timeRange{hours(1, 2)}, hours(3, 4), []timeRange{hours(1, 2), hours(3, 4)}},
+		{"overlapping", []timeRange{hours(1, 3)}, hours(2, 4), []timeRange{hours(1, 4)}},
+		{"touching", []timeRange{hours(1, 2)}, hours(2, 3), []timeRange{hours(1, 3)}},
+		{"bridging", []timeRange{hours(1, 2), hours(3, 4), hours(6, 7)}, hours(2, 3), []timeRange{hours(1, 4), hours(6, 7)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := mergeTimeRange(test.ranges, test.newRange); !reflect.DeepEqual(actual, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestSubtractTimeRanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		wanted   timeRange
+		ranges   []timeRange
+		expected []timeRange
+	}{
+		{"nothing fetched", hours(1, 5), []timeRange{}, []timeRange{hours(1, 5)}},
+		{"all fetched", hours(1, 5), []timeRange{hours(0, 6)}, []timeRange{}},
+		{"start fetched", hours(1, 5), []timeRange{hours(0, 2)}, []timeRange{hours(2, 5)}},
+		{"end fetched", hours(1, 5), []timeRange{hours(4, 6)}, []timeRange{hours(1, 4)}},
+		{"gaps", hours(1, 9), []timeRange{hours(2, 3), hours(5, 6)}, []timeRange{hours(1, 2), hours(3, 5), hours(6, 9)}},
+		{"outside", hours(3, 4), []timeRange{hours(1, 2), hours(5, 6)}, []timeRange{hours(3, 4)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := subtractTimeRanges(test.wanted, test.ranges); !reflect.DeepEqual(actual, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestSplitTimeRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		wanted   timeRange
+		expected []timeRange
+	}{
+		{"within a window", hours(1, 2), []timeRange{hours(1, 2)}},
+		{"aligned windows", hours(0, 12), []timeRange{hours(0, 4), hours(4, 8), hours(8, 12)}},
+		{"unaligned ends", hours(3, 9), []timeRange{hours(3, 4), hours(4, 8), hours(8, 9)}},
+		{"empty", hours(2, 2), []timeRange{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := splitTimeRange(test.wanted, 4*time.Hour); !reflect.DeepEqual(actual, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestReportingStoreSurvivesReopening(t *testing.T) {
+	directory, err := ioutil.TempDir("", "reporting-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "reporting.gob")
+	deployment := Deployment{
+		DeploymentId:        "Deployments-1",
+		ProjectId:           "Projects-1",
+		EnvironmentId:       "Environments-1",
+		CompletedTimeParsed: hours(1, 2).From,
+	}
+
+	saved := openReportingStore(path)
+	saved.add("Spaces-1", "", "", "", []timeRange{hours(0, 10)}, []Deployment{deployment})
+	saved.close()
+
+	store := openReportingStore(path)
+
+	if missing := store.missingRanges("Spaces-1", "Projects-1", "", "", hours(0, 12).From, hours(0, 12).To); !reflect.DeepEqual(missing, []timeRange{hours(10, 12)}) {
+		t.Fatalf("expected only the unfetched range to be missing, got %v", missing)
+	}
+
+	if deployments := store.deployments("Spaces-1", "Projects-1", "", hours(0, 10).From, hours(0, 10).To); len(deployments) != 1 || deployments[0].DeploymentId != "Deployments-1" {
+		t.Fatalf("expected the stored deployment, got %v", deployments)
+	}
+
+	if deployments := store.deployments("Spaces-1", "Projects-2", "", hours(0, 10).From, hours(0, 10).To); len(deployments) != 0 {
+		t.Fatalf("expected the project filter to be applied, got %v", deployments)
+	}
+}
+
+func TestReportingStoreSavesOnClose(t *testing.T) {
+	directory, err := ioutil.TempDir("", "reporting-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "reporting.gob")
+	store := openReportingStore(path)
+	store.add("Spaces-1", "", "", "", []timeRange{hours(0, 10)}, []Deployment{{DeploymentId: "Deployments-1"}})
+	store.add("Spaces-1", "", "", "", []timeRange{hours(10, 20)}, []Deployment{{DeploymentId: "Deployments-2"}})
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the adds to be saved later, got %v", err)
+	}
+
+	store.close()
+
+	if saved := openReportingStore(path).data.Deployments["Spaces-1"]; len(saved) != 2 {
+		t.Fatalf("expected both deployments to be saved when the store is closed, got %d", len(saved))
+	}
+}
+
+func TestReportingStorePath(t *testing.T) {
+	directory, err := ioutil.TempDir("", "reporting-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	path, _ := getReportingStorePath(directory, 1, "http://octopus", "API-1")
+	otherKey, _ := getReportingStorePath(directory, 1, "http://octopus", "API-2")
+	otherServer, _ := getReportingStorePath(directory, 1, "http://other", "API-1")
+	if path == otherKey || path == otherServer {
+		t.Fatal("expected the path to depend on the server and API key")
+	}
+
+	// the files of the datasource for another key are removed, but not those of other datasources
+	otherDatasource, _ := getReportingStorePath(directory, 2, "http://octopus", "API-1")
+	for _, file := range []string{path, otherKey, otherDatasource} {
+		if err := ioutil.WriteFile(file, []byte{}, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removeStaleReportingStores(path, 1)
+
+	for file, exists := range map[string]bool{path: true, otherKey: false, otherDatasource: true} {
+		if _, err := os.Stat(file); (err == nil) != exists {
+			t.Fatalf("expected %s to exist: %v", file, exists)
+		}
+	}
+}
+
+func TestReportingStoreIsTrimmed(t *testing.T) {
+	store := openReportingStore("")
+	store.maxDeployments = 2
+
+	deployments := []Deployment{}
+	for i, id := range []string{"Deployments-1", "Deployments-2", "Deployments-3"} {
+		deployments = append(deployments, Deployment{DeploymentId: id, CompletedTimeParsed: hours(i, i+1).From})
+	}
+	store.add("Spaces-1", "", "", "", []timeRange{hours(0, 10)}, deployments)
+
+	if stored := store.deployments("Spaces-1", "", "", hours(0, 10).From, hours(0, 10).To); len(stored) != 2 || stored[0].DeploymentId != "Deployments-2" {
+		t.Fatalf("expected the deployment that completed first to be removed, got %v", stored)
+	}
+
+	// the time of the removed deployment is requested again
+	if missing := store.missingRanges("Spaces-1", "", "", "", hours(0, 10).From, hours(0, 10).To); len(missing) != 1 || !missing[0].From.Equal(hours(0, 1).From) || !missing[0].To.After(hours(0, 1).From) || missing[0].To.After(hours(1, 2).From) {
+		t.Fatalf("expected only the time of the removed deployment to be missing, got %v", missing)
+	}
+}
+
+func TestReportingStoreIgnoresLocalTimeZone(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("AEST", 10*60*60)
+	defer func() { time.Local = local }()
+
+	store := openReportingStore("")
+	now := time.Now().UTC()
+	store.add("Spaces-1", "", "", "", []timeRange{{From: now.Add(-2 * time.Hour), To: now}}, []Deployment{})
+
+	// the unsettled time is requested again, and with the same dates as the ranges that were recorded
+	missing := store.missingRanges("Spaces-1", "", "", "", now.Add(-2*time.Hour), now)
+	if len(missing) != 1 || missing[0].From.Location() != time.UTC || !missing[0].To.Equal(now) {
+		t.Fatalf("expected the unsettled range to be missing in UTC, got %v", missing)
+	}
+
+	query := buildReportingQueryUrl("http://octopus", "", "", "", missing[0].From.In(time.Local), missing[0].To.In(time.Local))
+	expected := "fromCompletedTime=" + url.QueryEscape(missing[0].From.Format(octopusDateFormat))
+	if !strings.Contains(query, expected) {
+		t.Fatalf("expected the query to request %s, got %s", expected, query)
+	}
+}
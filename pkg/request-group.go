@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/trace"
+	"sync"
+	"time"
+)
+
+// requestCall is a request shared by every caller asking for the same key while it is in flight
+type requestCall struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+	// waiters is the number of callers still waiting on the result. The request is cancelled if they all give up.
+	waiters int
+	// deadlines holds the deadline of each waiting caller, with a zero time for a caller without a deadline
+	deadlines []time.Time
+	// timer cancels the call once the latest deadline passes, and expired is set when it does
+	timer   *time.Timer
+	expired bool
+	cancel  context.CancelFunc
+}
+
+// callContext is the context of a shared call. Its deadline is the latest deadline of the callers still waiting on
+// the call, so the call does not start work, like a retry, that would finish after every caller has given up.
+// The context is done once that deadline passes, and its error is then context.DeadlineExceeded.
+type callContext struct {
+	context.Context
+	group *requestGroup
+	call  *requestCall
+}
+
+func (c *callContext) Deadline() (time.Time, bool) {
+	c.group.mutex.Lock()
+	defer c.group.mutex.Unlock()
+
+	return c.call.latestDeadline()
+}
+
+func (c *callContext) Err() error {
+	c.group.mutex.Lock()
+	defer c.group.mutex.Unlock()
+
+	if c.call.expired {
+		return context.DeadlineExceeded
+	}
+	return c.Context.Err()
+}
+
+// latestDeadline returns the latest deadline of the waiting callers, and false if any of them has no deadline.
+// The caller must hold the mutex of the group.
+func (c *requestCall) latestDeadline() (time.Time, bool) {
+	latest := time.Time{}
+	for _, deadline := range c.deadlines {
+		if deadline.IsZero() {
+			// a caller is willing to wait forever
+			return time.Time{}, false
+		}
+		if deadline.After(latest) {
+			latest = deadline
+		}
+	}
+	return latest, !latest.IsZero()
+}
+
+// expire cancels the call as having exceeded its deadline. The caller must hold the mutex of the group.
+func (c *requestCall) expire() {
+	c.expired = true
+	c.cancel()
+}
+
+// resetTimer arms the timer for the latest deadline of the waiting callers, which changes as they join and leave.
+// The caller must hold the mutex.
+func (g *requestGroup) resetTimer(call *requestCall) {
+	if call.timer != nil {
+		call.timer.Stop()
+		call.timer = nil
+	}
+
+	latest, ok := call.latestDeadline()
+	if !ok {
+		return
+	}
+
+	call.timer = time.AfterFunc(time.Until(latest), func() {
+		g.mutex.Lock()
+		defer g.mutex.Unlock()
+
+		// the timer may have fired while being reset for a later deadline
+		if deadline, ok := call.latestDeadline(); ok && !time.Now().Before(deadline) {
+			call.expire()
+		}
+	})
+}
+
+// removeDeadline forgets the deadline of a caller that gave up on the call
+func (c *requestCall) removeDeadline(deadline time.Time) {
+	for i, d := range c.deadlines {
+		if d.Equal(deadline) {
+			c.deadlines = append(c.deadlines[:i], c.deadlines[i+1:]...)
+			return
+		}
+	}
+}
+
+// requestGroup coalesces concurrent identical requests, so only one is sent to Octopus and the callers share its
+// result or error. Unlike a cache, nothing is kept once the request completes.
+type requestGroup struct {
+	mutex sync.Mutex
+	calls map[string]*requestCall
+}
+
+func newRequestGroup() *requestGroup {
+	return &requestGroup{calls: map[string]*requestCall{}}
+}
+
+// do calls fn for the key, or waits on the call already in flight for the key. The call runs with its own context,
+// so the caller that started it can give up without failing the others, although it is still traced as part of the
+// request of that caller. The call is only cancelled once every caller has given up, or once the latest deadline of
+// the callers passes. shared is true if the caller joined a call that was already in flight.
+func (g *requestGroup) do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (value interface{}, err error, shared bool) {
+	// the context may be the context of another call of the group, which takes the mutex to read its deadline
+	deadline, _ := ctx.Deadline()
+
+	g.mutex.Lock()
+	call, inFlight := g.calls[key]
+	if !inFlight {
+		cancelCtx, cancel := context.WithCancel(trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx)))
+		call = &requestCall{done: make(chan struct{}), cancel: cancel}
+		callCtx := &callContext{Context: cancelCtx, group: g, call: call}
+		g.calls[key] = call
+
+		go func() {
+			value, err := fn(callCtx)
+
+			g.mutex.Lock()
+			if g.calls[key] == call {
+				delete(g.calls, key)
+			}
+			call.value = value
+			call.err = err
+			if call.timer != nil {
+				call.timer.Stop()
+			}
+			g.mutex.Unlock()
+
+			cancel()
+			close(call.done)
+		}()
+	}
+	call.waiters++
+	call.deadlines = append(call.deadlines, deadline)
+	g.resetTimer(call)
+	g.mutex.Unlock()
+
+	select {
+	case <-call.done:
+		g.mutex.Lock()
+		defer g.mutex.Unlock()
+		return call.value, call.err, inFlight
+	case <-ctx.Done():
+		err = ctx.Err()
+		g.mutex.Lock()
+		defer g.mutex.Unlock()
+		call.waiters--
+		call.removeDeadline(deadline)
+		g.resetTimer(call)
+		if call.waiters == 0 {
+			// later callers start a new call, rather than joining the one being cancelled
+			if g.calls[key] == call {
+				delete(g.calls, key)
+			}
+			if err == context.DeadlineExceeded {
+				call.expire()
+			} else {
+				call.cancel()
+			}
+		}
+		return nil, err, inFlight
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitForWaiters blocks until the call for the key has the number of waiters
+func waitForWaiters(t *testing.T, group *requestGroup, key string, waiters int) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		group.mutex.Lock()
+		call, ok := group.calls[key]
+		joined := ok && call.waiters == waiters
+		group.mutex.Unlock()
+		if joined {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %d callers to join the call", waiters)
+}
+
+func TestRequestGroupSharesResults(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		err   error
+	}{
+		{"value", "projects", nil},
+		{"error", nil, errors.New("Response code was 500")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			group := newRequestGroup()
+			release := make(chan struct{})
+			var calls int32
+
+			var wait sync.WaitGroup
+			var sharedCount int32
+			for i := 0; i < 5; i++ {
+				wait.Add(1)
+				go func() {
+					defer wait.Done()
+					value, err, shared := group.do(context.Background(), "url", func(ctx context.Context) (interface{}, error) {
+						atomic.AddInt32(&calls, 1)
+						<-release
+						return test.value, test.err
+					})
+					if value != test.value || err != test.err {
+						t.Errorf("expected %v, %v, got %v, %v", test.value, test.err, value, err)
+					}
+					if shared {
+						atomic.AddInt32(&sharedCount, 1)
+					}
+				}()
+			}
+
+			waitForWaiters(t, group, "url", 5)
+			close(release)
+			wait.Wait()
+
+			if calls != 1 || sharedCount != 4 {
+				t.Fatalf("expected 1 call shared by 4 callers, got %d calls shared by %d", calls, sharedCount)
+			}
+		})
+	}
+}
+
+func TestRequestGroupCancellation(t *testing.T) {
+	group := newRequestGroup()
+	release := make(chan struct{})
+	cancelled := make(chan struct{})
+
+	fn := func(ctx context.Context) (interface{}, error) {
+		select {
+		case <-release:
+			return "projects", nil
+		case <-ctx.Done():
+			close(cancelled)
+			return nil, ctx.Err()
+		}
+	}
+
+	// the caller that started the call gives up, but the other caller still gets the result
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	firstDone := make(chan error)
+	go func() {
+		_, err, _ := group.do(firstCtx, "url", fn)
+		firstDone <- err
+	}()
+	waitForWaiters(t, group, "url", 1)
+
+	secondDone := make(chan interface{})
+	go func() {
+		value, _, _ := group.do(context.Background(), "url", fn)
+		secondDone <- value
+	}()
+	waitForWaiters(t, group, "url", 2)
+
+	cancelFirst()
+	if err := <-firstDone; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the first caller to be cancelled, got %v", err)
+	}
+
+	close(release)
+	if value := <-secondDone; value != "projects" {
+		t.Fatalf("expected the second caller to get the result, got %v", value)
+	}
+
+	// the call is cancelled once every caller has given up
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err, _ := group.do(ctx, "other", func(ctx context.Context) (interface{}, error) {
+			<-ctx.Done()
+			close(cancelled)
+			return nil, ctx.Err()
+		})
+		done <- err
+	}()
+	waitForWaiters(t, group, "other", 1)
+	cancel()
+	<-done
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the call to be cancelled when its only caller gave up")
+	}
+}
+
+func TestRequestGroupDeadline(t *testing.T) {
+	var requests int32
+	server := newFlakyServer(&requests, "10", 503, 503)
+	defer server.Close()
+
+	policy := testRetryPolicy
+	policy.budget = time.Hour
+
+	group := newRequestGroup()
+	release := make(chan struct{})
+	deadlines := make(chan time.Time, 1)
+	fn := func(ctx context.Context) (interface{}, error) {
+		<-release
+		deadline, _ := ctx.Deadline()
+		deadlines <- deadline
+		return policy.sendRequest(ctx, &http.Client{}, server.URL, "")
+	}
+
+	// the shared call is not retried, as Octopus asks for a wait beyond the latest deadline of the callers
+	latest := time.Now().Add(3 * time.Second)
+	var wait sync.WaitGroup
+	for _, deadline := range []time.Time{time.Now().Add(2 * time.Second), latest} {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			_, err, _ := group.do(ctx, "url", fn)
+			var respErr *responseError
+			if !errors.As(err, &respErr) {
+				t.Errorf("expected the response error rather than waiting for the deadline, got %v", err)
+			}
+		}()
+	}
+	waitForWaiters(t, group, "url", 2)
+
+	start := time.Now()
+	close(release)
+	wait.Wait()
+
+	if deadline := <-deadlines; !deadline.Equal(latest) {
+		t.Fatalf("expected the call to have the latest deadline %v, got %v", latest, deadline)
+	}
+
+	if time.Since(start) > time.Second || requests != 1 {
+		t.Fatalf("expected the call to stop after 1 request, got %d requests in %s", requests, time.Since(start))
+	}
+}
+
+func TestRequestGroupExpiresAtDeadline(t *testing.T) {
+	group := newRequestGroup()
+	errs := make(chan error, 1)
+	fn := func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		errs <- ctx.Err()
+		return nil, ctx.Err()
+	}
+
+	// the caller with the later deadline gives up early, so the call is done at the deadline of the other caller
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(50*time.Millisecond))
+	defer cancel()
+	laterCtx, cancelLater := context.WithDeadline(context.Background(), time.Now().Add(time.Hour))
+
+	start := time.Now()
+	var wait sync.WaitGroup
+	for _, ctx := range []context.Context{ctx, laterCtx} {
+		ctx := ctx
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			group.do(ctx, "url", fn)
+		}()
+	}
+	waitForWaiters(t, group, "url", 2)
+	cancelLater()
+	wait.Wait()
+
+	select {
+	case err := <-errs:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("expected the call to exceed its deadline, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the call to be done at its deadline")
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the call to be done at the deadline, took %s", elapsed)
+	}
+}
+
+func TestRequestGroupTimerFollowsDeadlines(t *testing.T) {
+	group := newRequestGroup()
+	cancelCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	call := &requestCall{cancel: cancel}
+	ctx := &callContext{Context: cancelCtx, group: group, call: call}
+
+	// a caller with a later deadline joins before the first deadline passes
+	first := time.Now().Add(20 * time.Millisecond)
+	later := time.Now().Add(100 * time.Millisecond)
+	group.mutex.Lock()
+	call.deadlines = []time.Time{first}
+	group.resetTimer(call)
+	call.deadlines = append(call.deadlines, later)
+	group.resetTimer(call)
+	group.mutex.Unlock()
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("expected the call to wait for the later deadline")
+	case <-time.After(time.Until(first) + 20*time.Millisecond):
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the call to be done at the later deadline")
+	}
+
+	if time.Now().Before(later) || ctx.Err() != context.DeadlineExceeded {
+		t.Fatalf("expected the call to exceed the later deadline, got %v", ctx.Err())
+	}
+}
+
+func TestCreateRequestCoalescesConcurrentRequests(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		rw.Write([]byte(`[{"Id": "Projects-1", "Name": "Web"}]`))
+	}))
+	defer server.Close()
+
+	client := newTestClient(t, server.URL, "API-TEST")
+	url := server.URL + "/api/Spaces-1/projects/all"
+
+	var wait sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			body, err := client.createRequest(context.Background(), url, "")
+			if err != nil || string(body) != `[{"Id": "Projects-1", "Name": "Web"}]` {
+				t.Errorf("unexpected response %s, %v", body, err)
+			}
+		}()
+	}
+
+	waitForWaiters(t, client.requests, url, 10)
+	close(release)
+	wait.Wait()
+
+	if requests != 1 {
+		t.Fatalf("expected the concurrent requests to share 1 request to Octopus, got %d", requests)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"strconv"
+	"unicode/utf8"
+)
+
+const (
+	// maxLoggedBodySize is how much of each response body is logged when response body logging is enabled
+	maxLoggedBodySize = 2048
+	// redacted replaces the secrets removed from log entries
+	redacted = "REDACTED"
+)
+
+var (
+	// apiKeyRegex matches Octopus API keys
+	apiKeyRegex = regexp.MustCompile(`API-[A-Za-z0-9]{16,}`)
+	// secretPropertyRegex matches the values of JSON string properties whose names suggest they hold a secret
+	secretPropertyRegex = regexp.MustCompile(`(?i)("[^"]*(?:password|secret|token|apikey|api_key)[^"]*"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+	// secretParamRegex matches the values of query string parameters that hold a secret
+	secretParamRegex = regexp.MustCompile(`(?i)((?:password|secret|token|apikey|api_key)=)[^&\s]*`)
+	// logSpaceRegex matches the space id in the path of an Octopus url
+	logSpaceRegex = regexp.MustCompile(`/api/(Spaces-[0-9]+)(?:/|$)`)
+)
+
+// redactSecrets replaces the API keys, password and token properties, and secret query string parameters in
+// text that is about to be logged
+func redactSecrets(text string) string {
+	text = apiKeyRegex.ReplaceAllString(text, "API-"+redacted)
+	text = secretPropertyRegex.ReplaceAllString(text, `$1"`+redacted+`"`)
+	return secretParamRegex.ReplaceAllString(text, "${1}"+redacted)
+}
+
+// formatLoggedBody returns the redacted start of a response body. The whole body is redacted before it is
+// truncated, so a secret cut in half by the truncation can not escape the redaction.
+func formatLoggedBody(body []byte) string {
+	text := redactSecrets(string(body))
+	if len(text) <= maxLoggedBodySize {
+		return text
+	}
+
+	// don't split a multi byte character
+	end := maxLoggedBodySize
+	for end > 0 && !utf8.RuneStart(text[end]) {
+		end--
+	}
+	return text[:end] + "... (" + strconv.Itoa(len(body)) + " bytes)"
+}
+
+// getErrorStatus returns the status logged for a failed request, which is the HTTP status code returned by
+// Octopus, or a description of why no response was returned
+func getErrorStatus(err error) string {
+	var respErr *responseError
+	if errors.As(err, &respErr) {
+		return strconv.Itoa(respErr.statusCode)
+	}
+	return getRequestStatus(err)
+}
+
+// getRequestLogFields returns the structured fields that identify a request to Octopus in the log, followed
+// by any extra fields
+func (c *octopusClient) getRequestLogFields(requestUrl string, fields ...interface{}) []interface{} {
+	path := requestUrl
+	if parsed, err := url.Parse(requestUrl); err == nil {
+		path = parsed.Path
+	}
+
+	logFields := []interface{}{"instance", c.datasourceId, "endpoint", getEndpointTemplate(path)}
+	if match := logSpaceRegex.FindStringSubmatch(path); match != nil {
+		logFields = append(logFields, "space", match[1])
+	}
+	logFields = append(logFields, "url", redactSecrets(requestUrl))
+
+	return append(logFields, fields...)
+}
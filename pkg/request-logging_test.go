@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// logEntry is a message written to the recordingLogger, with its structured fields
+type logEntry struct {
+	level   string
+	message string
+	fields  map[string]string
+}
+
+// recordingLogger keeps the log entries written while it is the default logger
+type recordingLogger struct {
+	mutex   sync.Mutex
+	entries []logEntry
+}
+
+func (l *recordingLogger) record(level string, message string, args []interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	entry := logEntry{level: level, message: message, fields: map[string]string{}}
+	for i := 0; i+1 < len(args); i += 2 {
+		entry.fields[fmt.Sprint(args[i])] = fmt.Sprint(args[i+1])
+	}
+	l.entries = append(l.entries, entry)
+}
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) { l.record("debug", msg, args) }
+func (l *recordingLogger) Info(msg string, args ...interface{})  { l.record("info", msg, args) }
+func (l *recordingLogger) Warn(msg string, args ...interface{})  { l.record("warn", msg, args) }
+func (l *recordingLogger) Error(msg string, args ...interface{}) { l.record("error", msg, args) }
+
+// recordLogs replaces the default logger with a recordingLogger, until the returned function is called
+func recordLogs() (*recordingLogger, func()) {
+	previous := log.DefaultLogger
+	logger := &recordingLogger{}
+	log.DefaultLogger = logger
+	return logger, func() {
+		log.DefaultLogger = previous
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		expected string
+	}{
+		{"api key", "failed with API-ABCDEFGHIJKLMNOPQRST1234", "failed with API-REDACTED"},
+		{"password property", `{"Username": "alice", "Password": "hunter2"}`, `{"Username": "alice", "Password": "REDACTED"}`},
+		{"escaped quotes", `{"ClientSecret": "a\"b", "Name": "c"}`, `{"ClientSecret": "REDACTED", "Name": "c"}`},
+		{"token parameter", "http://octopus/api/users?token=abc&take=10", "http://octopus/api/users?token=REDACTED&take=10"},
+		{"nothing to redact", `{"Name": "Web", "Id": "Projects-1"}`, `{"Name": "Web", "Id": "Projects-1"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := redactSecrets(test.text); actual != test.expected {
+				t.Fatalf("expected %s, got %s", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestFormatLoggedBodyTruncates(t *testing.T) {
+	body := []byte(`{"Password": "` + strings.Repeat("x", maxLoggedBodySize) + `"}` + strings.Repeat("é", maxLoggedBodySize))
+
+	logged := formatLoggedBody(body)
+	if strings.Contains(logged, "xxx") {
+		t.Fatal("expected the secret to be redacted before the body was truncated")
+	}
+	if !strings.HasSuffix(logged, "... ("+fmt.Sprint(len(body))+" bytes)") {
+		t.Fatalf("expected the body to be truncated, got %s", logged)
+	}
+	if strings.ContainsRune(logged, '�') || len(logged) > maxLoggedBodySize+32 {
+		t.Fatal("expected the body to be truncated between characters")
+	}
+}
+
+func TestCreateRequestLogsBodiesOnlyWhenEnabled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(`{"EmailAddress": "alice@example.com", "ApiKey": "secret"}`))
+	}))
+	defer server.Close()
+
+	logger, restore := recordLogs()
+	defer restore()
+
+	client := newTestClient(t, server.URL, "API-TEST")
+	_, err := client.createRequest(context.Background(), server.URL+"/api/Spaces-1/users/Users-1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	completed := false
+	for _, entry := range logger.entries {
+		for _, value := range entry.fields {
+			if strings.Contains(value, "alice") {
+				t.Fatalf("expected the response body not to be logged, got %q", entry.message)
+			}
+		}
+
+		if entry.message == "GET request to Octopus completed" {
+			completed = true
+			expected := map[string]string{"instance": "1", "space": "Spaces-1", "endpoint": "/api/{id}/users/{id}", "status": "200"}
+			for name, value := range expected {
+				if entry.fields[name] != value {
+					t.Errorf("expected the %s field to be %s, got %s", name, value, entry.fields[name])
+				}
+			}
+			if empty(entry.fields["duration"]) {
+				t.Error("expected the duration to be logged")
+			}
+		}
+	}
+	if !completed {
+		t.Fatal("expected the completed request to be logged")
+	}
+
+	client.logResponseBodies = true
+	logger.entries = nil
+	_, err = client.createRequest(context.Background(), server.URL+"/api/Spaces-1/users/Users-1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range logger.entries {
+		if body, ok := entry.fields["body"]; ok {
+			expected := `{"EmailAddress": "alice@example.com", "ApiKey": "REDACTED"}`
+			if body != expected {
+				t.Fatalf("expected the body %s, got %s", expected, body)
+			}
+			return
+		}
+	}
+	t.Fatal("expected the response body to be logged")
+}
@@ -2,52 +2,86 @@ package main
 
 import (
 	"encoding/json"
-	"encoding/xml"
+	"errors"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
 
-// Keeps the last range of deployments that were requested. This allows us to only query
-// the new deployments that fall within the requested range, because calling
-// /api/reporting/deployments/xml can be expensive.
-var deploymentsCache = map[string][]Deployment{}
+// writeOctopusError responds with the description of an error returned by the Octopus client, and with the status
+// Octopus responded with if there was one
+func writeOctopusError(rw http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var respErr *responseError
+	if errors.As(err, &respErr) {
+		status = respErr.statusCode
+	}
+
+	http.Error(rw, describeError(err), status)
+}
 
 // handleProjectsMapping returns a map of project names to ids as part of a resource call
 func (ds *SampleDatasource) handleSpaceEntityMapping(rw http.ResponseWriter, req *http.Request, entityType string) {
-	pluginContext := httpadapter.PluginConfigFromContext(req.Context())
-	server, apiKey, cacheDuration := getConnectionDetails(pluginContext)
+	ctx := req.Context()
+	pluginContext := httpadapter.PluginConfigFromContext(ctx)
+	instance, err := ds.getInstance(pluginContext)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	pathElements := strings.Split(req.URL.Path, "/")
 	spaceId := ""
 	if len(pathElements) == 2 {
 		spaceId = pathElements[len(pathElements)-1]
 	}
-	entities, _ := getAllResources("spaces", server, spaceId, apiKey, cacheDuration)
+	entities, err := instance.client.GetResources(ctx, "spaces", spaceId)
+	if err != nil {
+		writeOctopusError(rw, err)
+		return
+	}
 	json, _ := json.Marshal(entities)
 	rw.Write(json)
 }
 
 // handleSpaces returns a list of all the space names as part of a resource call
 func (td *SampleDatasource) handleSpaces(rw http.ResponseWriter, req *http.Request) {
-	pluginContext := httpadapter.PluginConfigFromContext(req.Context())
-	server, apiKey, cacheDuration := getConnectionDetails(pluginContext)
-	entities, _ := getSpaceResources(server, apiKey, cacheDuration)
+	ctx := req.Context()
+	pluginContext := httpadapter.PluginConfigFromContext(ctx)
+	instance, err := td.getInstance(pluginContext)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	entities, err := instance.client.GetSpaces(ctx)
+	if err != nil {
+		writeOctopusError(rw, err)
+		return
+	}
 	json, _ := json.Marshal(entities)
 	rw.Write(json)
 }
 
 // handleResources returns a list of entities names as part of a resource call
 func (td *SampleDatasource) handleResources(rw http.ResponseWriter, req *http.Request) {
-	pluginContext := httpadapter.PluginConfigFromContext(req.Context())
-	server, apiKey, cacheDuration := getConnectionDetails(pluginContext)
+	ctx := req.Context()
+	pluginContext := httpadapter.PluginConfigFromContext(ctx)
+	instance, err := td.getInstance(pluginContext)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	pathElements := strings.Split(req.URL.Path, "/")
 
-	entities := map[string]string{}
 	resourceType := pathElements[len(pathElements)-1]
 	space := pathElements[len(pathElements)-3]
-	entities, _ = getAllResources(resourceType, server, space, apiKey, cacheDuration)
+	entities, err := instance.client.GetResources(ctx, resourceType, space)
+	if err != nil {
+		writeOctopusError(rw, err)
+		return
+	}
 
 	json, _ := json.Marshal(entities)
 	rw.Write(json)
@@ -55,16 +89,28 @@ func (td *SampleDatasource) handleResources(rw http.ResponseWriter, req *http.Re
 
 // handleResources returns a list of entities names as part of a resource call
 func (td *SampleDatasource) handleDeploymentResources(rw http.ResponseWriter, req *http.Request) {
-	pluginContext := httpadapter.PluginConfigFromContext(req.Context())
-	server, apiKey, cacheDuration := getConnectionDetails(pluginContext)
+	ctx := req.Context()
+	pluginContext := httpadapter.PluginConfigFromContext(ctx)
+	instance, err := td.getInstance(pluginContext)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	projectId := req.URL.Query().Get("projectId")
 	environmentId := req.URL.Query().Get("environmentId")
+	skip, _ := strconv.Atoi(req.URL.Query().Get("skip"))
+	take, _ := strconv.Atoi(req.URL.Query().Get("take"))
+	earliestDate, _ := time.Parse(octopusDateFormat, req.URL.Query().Get("fromCreated"))
+	latestDate, _ := time.Parse(octopusDateFormat, req.URL.Query().Get("toCreated"))
 
 	pathElements := strings.Split(req.URL.Path, "/")
 
-	var entities []PlainDeployment
 	space := pathElements[len(pathElements)-2]
-	entities, _ = getDeployments(server, space, apiKey, cacheDuration, projectId, environmentId)
+	entities, err := instance.client.GetDeployments(ctx, space, projectId, environmentId, skip, take, earliestDate, latestDate)
+	if err != nil {
+		writeOctopusError(rw, err)
+		return
+	}
 
 	json, _ := json.Marshal(entities)
 	rw.Write(json)
@@ -73,76 +119,121 @@ func (td *SampleDatasource) handleDeploymentResources(rw http.ResponseWriter, re
 // handleReportingRequest returns a list reporting deployments. It takes a request from the grafana frontend, calls
 // the Octopus XML endpoint, processes the XML, and returns the results as JSON.
 func (td *SampleDatasource) handleReportingRequest(rw http.ResponseWriter, req *http.Request) {
-	pluginContext := httpadapter.PluginConfigFromContext(req.Context())
-	server, apiKey, cacheDuration := getConnectionDetails(pluginContext)
+	ctx := req.Context()
+	pluginContext := httpadapter.PluginConfigFromContext(ctx)
+	instance, err := td.getInstance(pluginContext)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	pathElements := strings.Split(req.URL.Path, "/")
 	spaceId := pathElements[len(pathElements)-3]
 	projectId := req.URL.Query().Get("projectId")
 	environmentId := req.URL.Query().Get("environmentId")
-	earliestDate, _ := time.Parse(octopusDateFormat, req.URL.Query().Get("fromCompletedTime"))
-	latestDate, _ := time.Parse(octopusDateFormat, req.URL.Query().Get("toCompletedTime"))
-
-	if _, ok := deploymentsCache[spaceId]; !ok {
-		deploymentsCache[spaceId] = []Deployment{}
+	earliestDate, err := time.Parse(octopusDateFormat, req.URL.Query().Get("fromCompletedTime"))
+	if err != nil {
+		http.Error(rw, "The fromCompletedTime parameter must be a date like "+octopusDateFormat, http.StatusBadRequest)
+		return
 	}
-
-	// Prepend any deployments before the earliest cached record
-	if len(deploymentsCache) != 0 && deploymentsCache[spaceId][0].StartTimeParsed.After(earliestDate) {
-		query := buildReportingQueryUrl(server, spaceId, environmentId, projectId, earliestDate, deploymentsCache[spaceId][0].StartTimeParsed)
-		deployments := getReturnAndProcessDeployments(query, apiKey, cacheDuration)
-		deploymentsCache[spaceId] = append(deployments, deploymentsCache[spaceId]...)
+	latestDate, err := time.Parse(octopusDateFormat, req.URL.Query().Get("toCompletedTime"))
+	if err != nil {
+		http.Error(rw, "The toCompletedTime parameter must be a date like "+octopusDateFormat, http.StatusBadRequest)
+		return
 	}
-
-	// Append any deployments after the latest record
-	if len(deploymentsCache) != 0 && deploymentsCache[spaceId][len(deploymentsCache)-1].CompletedTimeParsed.Before(latestDate) {
-		query := buildReportingQueryUrl(server, spaceId, environmentId, projectId, deploymentsCache[spaceId][len(deploymentsCache)-1].CompletedTimeParsed, latestDate)
-		deployments := getReturnAndProcessDeployments(query, apiKey, cacheDuration)
-		deploymentsCache[spaceId] = append(deploymentsCache[spaceId], deployments...)
+	if err := validateReportingRange(earliestDate, latestDate); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	// Trim the cache to the new range
-	deploymentsCache[spaceId] = returnDeploymentsWithinRange(deploymentsCache[spaceId], earliestDate, latestDate)
-
-	deployment := Deployments{Deployments: deploymentsCache[spaceId]}
+	// The instance reporting store means only the deployments outside of the ranges that were
+	// previously requested are returned by Octopus, because calling /api/reporting/deployments/xml
+	// can be expensive.
+	deployments, err := instance.client.GetReportingDeployments(ctx, spaceId, environmentId, projectId, nil, earliestDate, latestDate)
+	if err != nil {
+		writeOctopusError(rw, err)
+		return
+	}
 
 	// Return JSON to the front end
-	json, _ := json.Marshal(deployment)
+	json, _ := json.Marshal(deployments)
 	rw.Write(json)
 }
 
-func getReturnAndProcessDeployments(query string, apiKey string, cacheDuration string) []Deployment {
-	// populate the data map with the results of the API query
-	deployments := &Deployments{}
-	xmlData, err := createRequest(query, apiKey, cacheDuration)
-	if err == nil {
-		xml.Unmarshal(xmlData, deployments)
-	}
+// adminRole is the Grafana organization role allowed to use the cache admin routes
+const adminRole = "Admin"
 
-	parseTimes(*deployments)
+// cacheAdminStats is returned by the cache stats route
+type cacheAdminStats struct {
+	Responses cacheStats          `json:"responses"`
+	Reporting reportingStoreStats `json:"reporting"`
+}
+
+// cachePurgeResult is returned by the cache purge route
+type cachePurgeResult struct {
+	Responses   int `json:"responses"`
+	Deployments int `json:"deployments"`
+}
+
+// getAdminInstance returns the datasource instance for the cache admin routes, writing an error
+// response and returning nil if the user is not a Grafana admin
+func (td *SampleDatasource) getAdminInstance(rw http.ResponseWriter, req *http.Request) *instanceSettings {
+	pluginContext := httpadapter.PluginConfigFromContext(req.Context())
+	if pluginContext.User == nil || pluginContext.User.Role != adminRole {
+		http.Error(rw, "Only Grafana admins can manage the datasource cache", http.StatusForbidden)
+		return nil
+	}
 
-	return deployments.Deployments
+	instance, err := td.getInstance(pluginContext)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	return instance
 }
 
-func returnDeploymentsWithinRange(deployments []Deployment, startTime time.Time, endTime time.Time) []Deployment {
-	values := []Deployment{}
-	for i := range deployments {
-		if !startTime.After(deployments[i].StartTimeParsed) && !endTime.Before(deployments[i].CompletedTimeParsed) {
-			// A sanity check to weed out duplicate deployment IDs. This catches the possibility
-			// that some query dates exactly overlapped.
-			if !deploymentsContains(values, deployments[i].DeploymentId) {
-				values = append(values, deployments[i])
-			}
-		}
-	}
-	return values
+// handleCacheStats returns the statistics of the response cache and reporting store as part of a resource call
+func (td *SampleDatasource) handleCacheStats(rw http.ResponseWriter, req *http.Request) {
+	instance := td.getAdminInstance(rw, req)
+	if instance == nil {
+		return
+	}
+
+	json, _ := json.Marshal(cacheAdminStats{
+		Responses: instance.cache.stats(),
+		Reporting: instance.reportingStore.stats(),
+	})
+	rw.Write(json)
 }
 
-func deploymentsContains(deployments []Deployment, deploymentId string) bool {
-	for _, d := range deployments {
-		if d.DeploymentId == deploymentId {
-			return true
-		}
+// handleCachePurge removes cached data as part of a resource call. The prefix query parameter purges
+// the responses whose url, with or without the server, starts with the prefix. The space query parameter
+// purges the responses and reporting deployments of one space. With neither, everything is purged.
+func (td *SampleDatasource) handleCachePurge(rw http.ResponseWriter, req *http.Request) {
+	instance := td.getAdminInstance(rw, req)
+	if instance == nil {
+		return
 	}
-	return false
+
+	server, _, _ := getConnectionDetails(httpadapter.PluginConfigFromContext(req.Context()))
+	prefix := req.URL.Query().Get("prefix")
+	spaceId := req.URL.Query().Get("space")
+
+	result := cachePurgeResult{}
+	if !empty(prefix) {
+		result.Responses = instance.cache.purge(func(url string) bool {
+			return strings.HasPrefix(url, prefix) || strings.HasPrefix(url, server+prefix)
+		})
+	} else if !empty(spaceId) {
+		result.Responses = instance.cache.purge(func(url string) bool {
+			return strings.Contains(url, "/api/"+spaceId+"/")
+		})
+		result.Deployments = instance.reportingStore.purge(spaceId)
+	} else {
+		result.Responses = instance.cache.purge(func(url string) bool { return true })
+		result.Deployments = instance.reportingStore.purge("")
+	}
+
+	json, _ := json.Marshal(result)
+	rw.Write(json)
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"sort"
 )
 
 func (td *SampleDatasource) queryResources(entities map[string]string, resourceType string) (backend.DataResponse, error) {
@@ -12,6 +13,9 @@ func (td *SampleDatasource) queryResources(entities map[string]string, resourceT
 		entityNames = append(entityNames, k)
 	}
 
+	// map iteration order is random, so sort the names to return them in a stable order
+	sort.Strings(entityNames)
+
 	// create data frame response
 	frame := data.NewFrame("response")
 
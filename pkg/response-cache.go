@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/dgraph-io/ristretto"
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the memory used to cache Octopus responses when the datasource does not define a cache size, in megabytes
+const defaultCacheSize = 100
+
+// the cost of an entry that is not a response, like the nil used by the circuit breaker
+const minimumCacheCost = 1
+
+// how often the expired entries are removed from the tracked entries
+const cachePruneInterval = time.Minute
+
+// responseCache holds the responses returned by Octopus to a datasource instance. Every key is prefixed with
+// a scope made from the datasource id and a hash of its credentials, so a response fetched with one API key
+// is never returned to a request made with another.
+type responseCache struct {
+	scope        string
+	datasourceId string
+	// maxCost is the number of bytes of responses the cache holds before evicting entries
+	maxCost int64
+	store   *ristretto.Cache
+	// guards against the store being used after the instance is disposed
+	mutex  sync.RWMutex
+	closed bool
+	// ristretto can not list its keys, so the entries are tracked here for the admin routes. ristretto may
+	// still decline an entry after it is set, without calling onEvict, so these are the entries that may be
+	// held rather than those that are. They are indexed by the key hash, as that is all ristretto passes to
+	// onEvict, and expired entries are pruned every cachePruneInterval.
+	entries      map[uint64]cacheEntry
+	entriesMutex sync.Mutex
+	lastPrune    time.Time
+}
+
+// cacheEntry describes a response held by the cache
+type cacheEntry struct {
+	url      string
+	conflict uint64
+	cost     int64
+	expires  time.Time
+	// failed entries are the errors recorded by the circuit breaker
+	failed bool
+}
+
+// cacheStats summarises the contents of a response cache. The entries and bytes are those ristretto has
+// accepted, while the circuit breaker entries are approximate, as ristretto may decline one after it is set.
+type cacheStats struct {
+	Hits                  uint64 `json:"hits"`
+	Misses                uint64 `json:"misses"`
+	Entries               int    `json:"entries"`
+	Bytes                 int64  `json:"bytes"`
+	MaxBytes              int64  `json:"maxBytes"`
+	CircuitBreakerEntries int    `json:"circuitBreakerEntries"`
+}
+
+// newResponseCache creates a cache holding up to sizeMegabytes of responses
+func newResponseCache(datasourceId int64, scope string, sizeMegabytes int) (*responseCache, error) {
+	if sizeMegabytes <= 0 {
+		sizeMegabytes = defaultCacheSize
+	}
+	maxCost := int64(sizeMegabytes) << 20
+
+	cache := &responseCache{
+		scope:        scope,
+		datasourceId: strconv.FormatInt(datasourceId, 10),
+		maxCost:      maxCost,
+		entries:      map[uint64]cacheEntry{},
+		lastPrune:    time.Now(),
+	}
+
+	store, err := ristretto.NewCache(&ristretto.Config{
+		/*
+		    NumCounters is the number of 4-bit access counters to keep for admission and eviction.
+		  We've seen good performance in setting this to 10x the number of items you expect to keep in the cache when full.
+		  Responses average somewhere around 10kb, so we expect maxCost/10kb items.
+		*/
+		NumCounters: maxCost / 1000,
+		/*
+		  MaxCost is how eviction decisions are made. The cost of each item is the size of the response in bytes,
+		  so this is the memory budget of the cache. For example, if MaxCost is 100 and a new item with a
+		  cost of 1 increases total cache cost to 101, 1 item will be evicted.
+		*/
+		MaxCost: maxCost,
+		/*
+		  BufferItems is the size of the Get buffers. The best value we've found for this is 64.
+		*/
+		BufferItems: 64, // number of keys per Get buffer.
+		/*
+		  Metrics track the hits, misses and evictions, which are exposed by the cacheCollector.
+		*/
+		Metrics: true,
+		/*
+		  OnEvict is called when an entry is evicted or expires, which keeps the tracked entries in sync.
+		*/
+		OnEvict: cache.onEvict,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cache.store = store
+	registerCache(cache)
+
+	return cache, nil
+}
+
+// getCacheCost returns the cost of a cache entry, which is the size of the response in bytes
+func getCacheCost(value interface{}) int64 {
+	if body, ok := value.([]byte); ok && len(body) > minimumCacheCost {
+		return int64(len(body))
+	}
+	return minimumCacheCost
+}
+
+// getCacheScope returns the prefix used for the cache keys of a datasource instance
+func getCacheScope(setting backend.DataSourceInstanceSettings) string {
+	// Any secure value, like the API key or custom header values, can change what Octopus returns. The
+	// jsonData is included too, as it holds the server url and custom header names.
+	names := []string{}
+	for name := range setting.DecryptedSecureJSONData {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hash := sha256.New()
+	for _, name := range names {
+		hash.Write([]byte(name + "=" + setting.DecryptedSecureJSONData[name] + "\n"))
+	}
+	hash.Write(setting.JSONData)
+
+	return strconv.FormatInt(setting.ID, 10) + "/" + hex.EncodeToString(hash.Sum(nil))[:16] + "/"
+}
+
+// get returns the cached response for the url. An error value indicates a failed request.
+func (c *responseCache) get(url string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.closed {
+		return nil, false
+	}
+
+	return c.store.Get(c.scope + url)
+}
+
+// set caches the response for the url
+func (c *responseCache) set(url string, value interface{}, ttl time.Duration) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.closed {
+		return
+	}
+
+	cost := getCacheCost(value)
+	if !c.store.SetWithTTL(c.scope+url, value, cost, ttl) {
+		return
+	}
+
+	key, conflict := z.KeyToHash(c.scope + url)
+	_, isResponse := value.([]byte)
+	entry := cacheEntry{url: url, conflict: conflict, cost: cost, failed: !isResponse}
+	if entry.failed {
+		circuitBreakerTrips.WithLabelValues(c.datasourceId).Inc()
+	}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+
+	c.entriesMutex.Lock()
+	defer c.entriesMutex.Unlock()
+	c.entries[key] = entry
+
+	// the entries ristretto declined are never passed to onEvict, so they are removed once they expire
+	if now := time.Now(); now.Sub(c.lastPrune) > cachePruneInterval {
+		c.lastPrune = now
+		for key, entry := range c.entries {
+			if entry.expired(now) {
+				delete(c.entries, key)
+			}
+		}
+	}
+}
+
+// expired returns true if the entry is past its ttl
+func (e cacheEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && e.expires.Before(now)
+}
+
+// onEvict stops tracking the entries ristretto has removed
+func (c *responseCache) onEvict(key uint64, conflict uint64, value interface{}, cost int64) {
+	c.entriesMutex.Lock()
+	defer c.entriesMutex.Unlock()
+
+	if entry, ok := c.entries[key]; ok && entry.conflict == conflict {
+		delete(c.entries, key)
+	}
+}
+
+// stats returns the statistics of the cache
+func (c *responseCache) stats() cacheStats {
+	stats := cacheStats{}
+	if c == nil {
+		return stats
+	}
+
+	stats.MaxBytes = c.maxCost
+	if c.store.Metrics != nil {
+		stats.Hits = c.store.Metrics.Hits()
+		stats.Misses = c.store.Metrics.Misses()
+		// the keys and costs are only counted once ristretto accepts an entry, and deletions and expiries count as evictions
+		stats.Entries = int(int64(c.store.Metrics.KeysAdded()) - int64(c.store.Metrics.KeysEvicted()))
+		stats.Bytes = int64(c.store.Metrics.CostAdded()) - int64(c.store.Metrics.CostEvicted())
+	}
+
+	c.entriesMutex.Lock()
+	defer c.entriesMutex.Unlock()
+
+	now := time.Now()
+	for _, entry := range c.entries {
+		if entry.failed && !entry.expired(now) {
+			stats.CircuitBreakerEntries++
+		}
+	}
+
+	return stats
+}
+
+// purge removes the cached responses whose url matches, returning the number of responses removed
+func (c *responseCache) purge(matches func(url string) bool) int {
+	if c == nil {
+		return 0
+	}
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.closed {
+		return 0
+	}
+
+	urls := []string{}
+	c.entriesMutex.Lock()
+	for key, entry := range c.entries {
+		if matches(entry.url) {
+			urls = append(urls, entry.url)
+			delete(c.entries, key)
+		}
+	}
+	c.entriesMutex.Unlock()
+
+	// Del blocks while the ristretto set buffer is full, and the goroutine that drains it calls onEvict, which
+	// takes the entries mutex. So the entries mutex must not be held while deleting.
+	for _, url := range urls {
+		c.store.Del(c.scope + url)
+	}
+
+	return len(urls)
+}
+
+// close removes all the cached responses and releases the cache
+func (c *responseCache) close() {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return
+	}
+
+	c.closed = true
+	unregisterCache(c)
+	c.store.Clear()
+	c.store.Close()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// waitForCacheStats returns the stats of the cache once ristretto has processed the sets and deletes, which it does
+// in the background
+func waitForCacheStats(t *testing.T, cache *responseCache, ready func(stats cacheStats) bool) cacheStats {
+	stats := cache.stats()
+	for start := time.Now(); !ready(stats) && time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		stats = cache.stats()
+	}
+	return stats
+}
+
+func TestResponseCachePurge(t *testing.T) {
+	cache, err := newResponseCache(1, "1/test/", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.close()
+
+	cache.set("http://octopus/api/Spaces-1/projects", []byte("projects"), time.Hour)
+	cache.set("http://octopus/api/Spaces-1/environments", []byte("environments"), time.Hour)
+	cache.set("http://octopus/api/Spaces-2/projects", nil, time.Hour)
+
+	expectedBytes := int64(len("projects") + len("environments") + minimumCacheCost)
+	stats := waitForCacheStats(t, cache, func(stats cacheStats) bool { return stats.Entries == 3 })
+	if stats.Entries != 3 || stats.Bytes != expectedBytes || stats.CircuitBreakerEntries != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	if purged := cache.purge(func(url string) bool { return url == "http://octopus/api/Spaces-1/projects" }); purged != 1 {
+		t.Fatalf("expected 1 response to be purged, got %d", purged)
+	}
+
+	if _, ok := cache.get("http://octopus/api/Spaces-1/projects"); ok {
+		t.Fatal("expected the purged response to be removed")
+	}
+
+	if stats := waitForCacheStats(t, cache, func(stats cacheStats) bool { return stats.Entries == 2 }); stats.Entries != 2 {
+		t.Fatalf("expected 2 entries after the purge, got %d", stats.Entries)
+	}
+}
+
+func TestResponseCacheStatsIgnoreDeclinedEntries(t *testing.T) {
+	cache, err := newResponseCache(1, "1/test/", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.close()
+
+	// ristretto declines a response larger than the whole cache, without calling onEvict
+	cache.set("http://octopus/api/Spaces-1/releases", make([]byte, 2<<20), time.Hour)
+	cache.set("http://octopus/api/Spaces-1/projects", []byte("projects"), time.Hour)
+
+	// the sets are processed in order, so the declined response has been processed once the other is counted
+	stats := waitForCacheStats(t, cache, func(stats cacheStats) bool { return stats.Entries != 0 })
+	if stats.Entries != 1 || stats.Bytes != int64(len("projects")) {
+		t.Fatalf("expected only the accepted response to be counted, got %+v", stats)
+	}
+}
+
+// resourceResponse collects the response sent by a resource call
+type resourceResponse struct {
+	status int
+	body   []byte
+}
+
+func (r *resourceResponse) Send(response *backend.CallResourceResponse) error {
+	r.status = response.Status
+	r.body = append(r.body, response.Body...)
+	return nil
+}
+
+func TestCacheRoutesRequireAdmin(t *testing.T) {
+	handler := newDatasource().CallResourceHandler
+
+	tests := []struct {
+		name     string
+		user     *backend.User
+		method   string
+		path     string
+		expected int
+	}{
+		{"anonymous stats", nil, http.MethodGet, "cache", http.StatusForbidden},
+		{"viewer stats", &backend.User{Role: "Viewer"}, http.MethodGet, "cache", http.StatusForbidden},
+		{"editor purge", &backend.User{Role: "Editor"}, http.MethodPost, "cache/purge", http.StatusForbidden},
+		{"admin stats", &backend.User{Role: adminRole}, http.MethodGet, "cache", http.StatusOK},
+		{"admin purge", &backend.User{Role: adminRole}, http.MethodPost, "cache/purge", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := &resourceResponse{}
+			err := handler.CallResource(context.Background(), &backend.CallResourceRequest{
+				PluginContext: backend.PluginContext{
+					User:                       test.user,
+					DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{ID: 1},
+				},
+				Path:   test.path,
+				Method: test.method,
+				URL:    test.path,
+			}, response)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if response.status != test.expected {
+				t.Fatalf("expected status %d, got %d: %s", test.expected, response.status, response.body)
+			}
+
+			if test.expected == http.StatusOK && !json.Valid(response.body) {
+				t.Fatalf("expected a JSON response, got %s", response.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// retryableStatusCodes are the HTTP responses that indicate a transient failure
+var retryableStatusCodes = map[int]bool{
+	http.StatusTooManyRequests:    true,
+	http.StatusBadGateway:         true,
+	http.StatusServiceUnavailable: true,
+	http.StatusGatewayTimeout:     true,
+}
+
+// retryPolicy defines how transient failures when calling Octopus are retried
+type retryPolicy struct {
+	// maxAttempts is the total number of requests, including the first one
+	maxAttempts int
+	// initialBackoff is the wait before the first retry, which doubles with each retry
+	initialBackoff time.Duration
+	// maxBackoff caps the wait between any two requests
+	maxBackoff time.Duration
+	// budget is the total time that can be spent on a request and its retries. No retry
+	// is attempted if it would start after the budget is spent.
+	budget time.Duration
+}
+
+var defaultRetryPolicy = retryPolicy{
+	maxAttempts:    4,
+	initialBackoff: 500 * time.Millisecond,
+	maxBackoff:     10 * time.Second,
+	budget:         30 * time.Second,
+}
+
+// responseError is returned when Octopus responds with anything other than a 200
+type responseError struct {
+	url        string
+	statusCode int
+	retryAfter time.Duration
+	// message is the ErrorMessage returned by Octopus, if any
+	message string
+}
+
+func (e *responseError) Error() string {
+	if !empty(e.message) {
+		return "Response code to " + e.url + " was " + strconv.Itoa(e.statusCode) + ": " + e.message
+	}
+	return "Response code to " + e.url + " was " + strconv.Itoa(e.statusCode)
+}
+
+// maxErrorBodySize limits how much of a failed response is read looking for the error message
+const maxErrorBodySize = 64 * 1024
+
+// readErrorMessage returns the ErrorMessage from the JSON body Octopus returns with a failed request
+func readErrorMessage(body io.Reader) string {
+	var octopusError struct {
+		ErrorMessage string
+	}
+	json.NewDecoder(io.LimitReader(body, maxErrorBodySize)).Decode(&octopusError)
+	return octopusError.ErrorMessage
+}
+
+// responseReader consumes the body of a successful response. It is called again for each retry, so
+// it must discard anything it read from a previous attempt.
+type responseReader func(body io.Reader) error
+
+// sendRequest makes a GET request to Octopus and returns the response body. See streamRequest for how
+// failures are retried.
+func (p retryPolicy) sendRequest(ctx context.Context, client *http.Client, url string, apiKey string) ([]byte, error) {
+	var body []byte
+	err := p.streamRequest(ctx, client, url, apiKey, func(reader io.Reader) error {
+		var err error
+		body, err = ioutil.ReadAll(reader)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// streamRequest makes a GET request to Octopus, passing the response body to read as it is received.
+// Transient failures, including those while reading the body, are retried with a jittered exponential backoff.
+// The error from the last attempt is returned once the attempts or time budget are exhausted. The retries stop
+// as soon as the context is cancelled, and are never scheduled to start after the context deadline.
+func (p retryPolicy) streamRequest(ctx context.Context, client *http.Client, url string, apiKey string, read responseReader) error {
+	start := time.Now()
+
+	for attempt := 1; ; attempt++ {
+		err := sendRequestOnce(ctx, client, url, apiKey, read)
+		if err == nil || ctx.Err() != nil || !isTransientError(err) || attempt >= p.maxAttempts {
+			return err
+		}
+
+		wait := p.backoff(attempt)
+		var respErr *responseError
+		if errors.As(err, &respErr) && respErr.retryAfter > 0 {
+			// Octopus told us how long to wait, so respect that over our own backoff
+			wait = respErr.retryAfter
+		}
+
+		if time.Since(start)+wait > p.budget {
+			log.DefaultLogger.Warn("Not retrying GET request to Octopus as the wait exceeds the retry budget", "url", redactSecrets(url), "wait", wait.String())
+			return err
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			log.DefaultLogger.Warn("Not retrying GET request to Octopus as the wait exceeds the query deadline", "url", redactSecrets(url), "wait", wait.String())
+			return err
+		}
+
+		log.DefaultLogger.Warn("GET request to Octopus failed, retrying", "url", redactSecrets(url), "attempt", attempt, "status", getErrorStatus(err), "error", redactSecrets(err.Error()), "wait", wait.String())
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns the wait before the given retry attempt. The wait is randomly chosen between half and all
+// of the exponential backoff, so many clients that failed together do not all retry together.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.initialBackoff << uint(attempt-1)
+	if backoff <= 0 || backoff > p.maxBackoff {
+		backoff = p.maxBackoff
+	}
+
+	half := int64(backoff / 2)
+	if half <= 0 {
+		return backoff
+	}
+
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// sendRequestOnce makes a single GET request to Octopus, passing the response body to read
+func sendRequestOnce(ctx context.Context, client *http.Client, url string, apiKey string, read responseReader) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("X-Octopus-ApiKey", apiKey)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return &responseError{
+			url:        url,
+			statusCode: resp.StatusCode,
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+			message:    readErrorMessage(resp.Body),
+		}
+	}
+
+	return read(resp.Body)
+}
+
+// isTransientError returns true if the error is worth retrying
+func isTransientError(err error) bool {
+	var respErr *responseError
+	if errors.As(err, &respErr) {
+		return retryableStatusCodes[respErr.statusCode]
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// parseRetryAfter parses the Retry-After header, which is either a number of seconds or a HTTP date
+func parseRetryAfter(retryAfter string) time.Duration {
+	if empty(retryAfter) {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(retryAfter); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testRetryPolicy = retryPolicy{
+	maxAttempts:    3,
+	initialBackoff: time.Millisecond,
+	maxBackoff:     10 * time.Millisecond,
+	budget:         time.Second,
+}
+
+// newFlakyServer returns a server that responds with the given status codes in order, then 200
+func newFlakyServer(requests *int32, retryAfter string, statusCodes ...int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		count := int(atomic.AddInt32(requests, 1))
+		if count <= len(statusCodes) {
+			if retryAfter != "" {
+				rw.Header().Set("Retry-After", retryAfter)
+			}
+			rw.WriteHeader(statusCodes[count-1])
+			return
+		}
+		rw.Write([]byte("ok"))
+	}))
+}
+
+func TestRetryTransientFailures(t *testing.T) {
+	tests := []struct {
+		name        string
+		statusCodes []int
+		retryAfter  string
+		expectOk    bool
+		requests    int32
+	}{
+		{"success", []int{}, "", true, 1},
+		{"retries 503", []int{503, 502}, "", true, 3},
+		{"gives up after max attempts", []int{503, 503, 503, 503}, "", false, 3},
+		{"does not retry 404", []int{404}, "", false, 1},
+		{"retry after exceeding the budget", []int{429}, "120", false, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var requests int32
+			server := newFlakyServer(&requests, test.retryAfter, test.statusCodes...)
+			defer server.Close()
+
+			body, err := testRetryPolicy.sendRequest(context.Background(), &http.Client{}, server.URL, "")
+
+			if test.expectOk && (err != nil || string(body) != "ok") {
+				t.Fatalf("expected success, got %v", err)
+			}
+
+			if !test.expectOk && err == nil {
+				t.Fatal("expected an error")
+			}
+
+			if requests != test.requests {
+				t.Fatalf("expected %d requests, got %d", test.requests, requests)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if parseRetryAfter("5") != 5*time.Second {
+		t.Fatal("expected Retry-After in seconds to be parsed")
+	}
+
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if wait := parseRetryAfter(date); wait <= 50*time.Second || wait > time.Minute {
+		t.Fatalf("expected Retry-After date to be about a minute away, got %s", wait)
+	}
+
+	if parseRetryAfter("") != 0 || parseRetryAfter("soon") != 0 {
+		t.Fatal("expected invalid Retry-After to be ignored")
+	}
+}
+
+func TestRetryStopsWhenCancelled(t *testing.T) {
+	var requests int32
+	server := newFlakyServer(&requests, "", 503, 503, 503)
+	defer server.Close()
+
+	policy := testRetryPolicy
+	policy.initialBackoff = time.Minute
+	policy.maxBackoff = time.Minute
+	policy.budget = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := policy.sendRequest(ctx, &http.Client{}, server.URL, "")
+
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if time.Since(start) > 10*time.Second {
+		t.Fatal("expected the retry to respect the context deadline")
+	}
+
+	if requests != 1 {
+		t.Fatalf("expected 1 request, got %d", requests)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// serverVersion is the version of an Octopus server, like 2020.5.2
+type serverVersion struct {
+	major int
+	minor int
+	patch int
+}
+
+// parseServerVersion parses the version returned by /api. Any pre-release or build suffix is ignored.
+func parseServerVersion(version string) (serverVersion, error) {
+	if index := strings.IndexAny(version, "-+"); index >= 0 {
+		version = version[:index]
+	}
+
+	parts := strings.Split(version, ".")
+	if len(parts) < 2 || len(parts) > 4 {
+		return serverVersion{}, errors.New("Failed to parse the Octopus version " + version)
+	}
+
+	numbers := []int{}
+	for _, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil {
+			return serverVersion{}, errors.New("Failed to parse the Octopus version " + version)
+		}
+		numbers = append(numbers, number)
+	}
+
+	parsed := serverVersion{major: numbers[0], minor: numbers[1]}
+	if len(numbers) > 2 {
+		parsed.patch = numbers[2]
+	}
+	return parsed, nil
+}
+
+// atLeast returns true if the version is the same as, or later than, other
+func (v serverVersion) atLeast(other serverVersion) bool {
+	if v.major != other.major {
+		return v.major > other.major
+	}
+	if v.minor != other.minor {
+		return v.minor > other.minor
+	}
+	return v.patch >= other.patch
+}
+
+// isDevelopmentVersion returns true for the versions reported by development builds of Octopus, which are built
+// from the latest code. These report 0.0.0, or a pre-release version tagged as a local build.
+func isDevelopmentVersion(version string, parsed serverVersion) bool {
+	if parsed == (serverVersion{}) {
+		return true
+	}
+
+	index := strings.IndexAny(version, "-+")
+	return index >= 0 && strings.Contains(strings.ToLower(version[index:]), "local")
+}
+
+// String returns the major and minor version, which is how Octopus releases are usually referred to
+func (v serverVersion) String() string {
+	return strconv.Itoa(v.major) + "." + strconv.Itoa(v.minor)
+}
+
+// capability is a part of the Octopus API that is not available on every server the plugin connects to
+type capability struct {
+	// name describes the capability in errors
+	name string
+	// since is the first version of Octopus with the capability
+	since serverVersion
+}
+
+// The capability table. Servers older than these versions are sent to an alternative endpoint where there is
+// one, or the query fails with an error naming the server version.
+var (
+	// spacesCapability is the /api/spaces endpoint, and the space scoped endpoints like /api/Spaces-1/projects
+	spacesCapability = capability{name: "Spaces", since: serverVersion{major: 2019, minor: 1}}
+	// reportingCapability is the /api/reporting/deployments/xml feed used by the table and timeseries formats
+	reportingCapability = capability{name: "The deployments reporting endpoint", since: serverVersion{major: 3, minor: 1}}
+	// allRoutesCapability is the /all endpoint of resources like projects, which older servers return as a paged collection
+	allRoutesCapability = capability{name: "The /all endpoints", since: serverVersion{major: 3, minor: 0}}
+	// releaseAssembledCapability is the Assembled date of releases, used to calculate the release lead time
+	releaseAssembledCapability = capability{name: "The release lead time", since: serverVersion{major: 3, minor: 0}}
+	// tenantsCapability is the /api/tenants endpoint
+	tenantsCapability = capability{name: "Tenants", since: serverVersion{major: 3, minor: 4}}
+)
+
+// resourceCapabilities are the capabilities required by resource types that not every server has
+var resourceCapabilities = map[string]capability{
+	"spaces":  spacesCapability,
+	"tenants": tenantsCapability,
+}
+
+// serverCapabilities describes what the Octopus server of a datasource instance supports
+type serverCapabilities struct {
+	version serverVersion
+	// unknownVersion is set if the version could not be parsed, or is that of a development build, in which
+	// case the server is assumed to support everything
+	unknownVersion bool
+}
+
+func newServerCapabilities(version string) serverCapabilities {
+	parsed, err := parseServerVersion(version)
+	if err != nil || isDevelopmentVersion(version, parsed) {
+		return serverCapabilities{unknownVersion: true}
+	}
+	return serverCapabilities{version: parsed}
+}
+
+// supports returns true if the server has the capability
+func (s serverCapabilities) supports(c capability) bool {
+	return s.unknownVersion || s.version.atLeast(c.since)
+}
+
+// require returns an error naming the server version if the server does not have the capability
+func (s serverCapabilities) require(c capability) error {
+	if s.supports(c) {
+		return nil
+	}
+	return errors.New(c.name + " is not supported on Octopus " + s.version.String() + ", and requires Octopus " + c.since.String() + " or later")
+}
+
+// requireResource returns an error if the server does not have the resource type
+func (s serverCapabilities) requireResource(resourceType string) error {
+	if c, ok := resourceCapabilities[resourceType]; ok {
+		return s.require(c)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseServerVersion(t *testing.T) {
+	tests := []struct {
+		version  string
+		expected serverVersion
+		valid    bool
+	}{
+		{"2020.5.2", serverVersion{2020, 5, 2}, true},
+		{"3.17", serverVersion{3, 17, 0}, true},
+		{"2021.1.7316-ci0001", serverVersion{2021, 1, 7316}, true},
+		{"0.0.0-local", serverVersion{0, 0, 0}, true},
+		{"latest", serverVersion{}, false},
+		{"", serverVersion{}, false},
+	}
+
+	for _, test := range tests {
+		actual, err := parseServerVersion(test.version)
+		if (err == nil) != test.valid || actual != test.expected {
+			t.Errorf("parseServerVersion(%q) = %v, %v, expected %v", test.version, actual, err, test.expected)
+		}
+	}
+}
+
+func TestServerCapabilities(t *testing.T) {
+	tests := []struct {
+		version  string
+		expected map[string]bool
+	}{
+		{"2020.5.2", map[string]bool{"Spaces": true, "Tenants": true, "The /all endpoints": true}},
+		{"2018.10.0", map[string]bool{"Spaces": false, "Tenants": true, "The /all endpoints": true}},
+		{"3.2.0", map[string]bool{"Spaces": false, "Tenants": false, "The /all endpoints": true}},
+		{"2.6.5", map[string]bool{"Spaces": false, "Tenants": false, "The /all endpoints": false}},
+		{"unknown", map[string]bool{"Spaces": true, "Tenants": true, "The /all endpoints": true}},
+		{"0.0.0-local", map[string]bool{"Spaces": true, "Tenants": true, "The /all endpoints": true}},
+		{"0.0.0", map[string]bool{"Spaces": true, "Tenants": true, "The /all endpoints": true}},
+		{"2018.10.0-local", map[string]bool{"Spaces": true, "Tenants": true, "The /all endpoints": true}},
+		{"2018.10.0-ci0001", map[string]bool{"Spaces": false, "Tenants": true, "The /all endpoints": true}},
+	}
+
+	for _, test := range tests {
+		capabilities := newServerCapabilities(test.version)
+		actual := map[string]bool{}
+		for _, c := range []capability{spacesCapability, tenantsCapability, allRoutesCapability} {
+			actual[c.name] = capabilities.supports(c)
+		}
+
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("expected Octopus %s to support %v, got %v", test.version, test.expected, actual)
+		}
+	}
+
+	expected := "Tenants is not supported on Octopus 3.2, and requires Octopus 3.4 or later"
+	if err := newServerCapabilities("3.2.0").requireResource("tenants"); err == nil || err.Error() != expected {
+		t.Fatalf("expected the error %q, got %v", expected, err)
+	}
+}
+
+func TestClientUsesServerCapabilities(t *testing.T) {
+	requested := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requested = append(requested, req.URL.Path)
+		switch req.URL.Path {
+		case "/api":
+			rw.Write([]byte(`{"Application": "Octopus Deploy", "Version": "2.6.5"}`))
+		case "/api/projects":
+			rw.Write([]byte(`{"ItemType": "Project", "TotalResults": 1, "ItemsPerPage": 30, "Items": [{"Id": "Projects-1", "Name": "Web"}], "Links": {}}`))
+		default:
+			http.NotFound(rw, req)
+		}
+	}))
+	defer server.Close()
+
+	client := newTestClient(t, server.URL, "API-TEST")
+	ctx := context.Background()
+
+	spaces, err := client.GetResources(ctx, "spaces", "")
+	if err != nil || len(spaces) != 0 {
+		t.Fatalf("expected no spaces, got %v, %v", spaces, err)
+	}
+
+	projects, err := client.GetResources(ctx, "projects", "")
+	if err != nil || !reflect.DeepEqual(projects, map[string]string{"Web": "Projects-1"}) {
+		t.Fatalf("expected the projects from the paged collection, got %v, %v", projects, err)
+	}
+
+	_, err = client.GetResources(ctx, "tenants", "")
+	if err == nil || err.Error() != "Tenants is not supported on Octopus 2.6, and requires Octopus 3.4 or later" {
+		t.Fatalf("expected tenants to be unsupported, got %v", err)
+	}
+
+	_, err = client.GetReportingDeployments(ctx, "", "", "", nil, time.Now().Add(-time.Hour), time.Now())
+	if err == nil || err.Error() != "The deployments reporting endpoint is not supported on Octopus 2.6, and requires Octopus 3.1 or later" {
+		t.Fatalf("expected the reporting endpoint to be unsupported, got %v", err)
+	}
+
+	// the version is only read once
+	if !reflect.DeepEqual(requested, []string{"/api", "/api/projects"}) {
+		t.Fatalf("unexpected requests %v", requested)
+	}
+}
+
+func TestCapabilitiesWaitOnTheContextOfEachCaller(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		rw.Write([]byte(`{"Application": "Octopus Deploy", "Version": "2020.1.0"}`))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := newTestClient(t, server.URL, "API-TEST")
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := client.GetCapabilities(context.Background())
+		read <- err
+	}()
+	waitForWaiters(t, client.requests, server.URL+"/api", 1)
+
+	// a caller that gives up is not held by the request in flight for another caller
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := client.GetCapabilities(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the caller to give up at its deadline, got %v", err)
+	}
+
+	release <- struct{}{}
+	if err := <-read; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.GetCapabilities(context.Background()); err != nil || requests != 1 {
+		t.Fatalf("expected the capabilities to be read once, got %d requests, %v", requests, err)
+	}
+}
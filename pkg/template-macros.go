@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// allValue is the filter value that matches everything, in the same way as an empty filter. Grafana sends it for
+// a template variable with the All option selected and no custom all value.
+const allValue = "$__all"
+
+var (
+	// macroRegex matches the built-in Grafana macros, like $__from or ${__from}
+	macroRegex = regexp.MustCompile(`\$\{(__[a-z_]+)\}|\$(__[a-z_]+)`)
+	// variableRegex matches a filter that is only a template variable, like $project, ${project} or [[project]]
+	variableRegex = regexp.MustCompile(`^(\$[A-Za-z0-9_]+|\$\{[A-Za-z0-9_:.]+\}|\[\[[A-Za-z0-9_:.]+\]\])$`)
+)
+
+// interpolateMacros replaces the built-in Grafana macros that the backend knows the value of. The frontend
+// replaces these before a panel query is sent, but alert rules and other backend evaluations send them as they
+// were entered. Unknown macros are left as they are.
+func interpolateMacros(text string, query backend.DataQuery) string {
+	if !strings.Contains(text, "$") {
+		return text
+	}
+
+	return macroRegex.ReplaceAllStringFunc(text, func(macro string) string {
+		name := strings.Trim(macro, "${}")
+		switch name {
+		case "__from":
+			return strconv.FormatInt(query.TimeRange.From.UnixNano()/int64(time.Millisecond), 10)
+		case "__to":
+			return strconv.FormatInt(query.TimeRange.To.UnixNano()/int64(time.Millisecond), 10)
+		case "__interval":
+			return formatInterval(getQueryInterval(query))
+		case "__interval_ms":
+			return strconv.FormatInt(int64(getQueryInterval(query)/time.Millisecond), 10)
+		}
+		return macro
+	})
+}
+
+// getQueryInterval returns the interval Grafana suggests for the query, working it out from the time range and
+// maximum number of points if Grafana did not send one
+func getQueryInterval(query backend.DataQuery) time.Duration {
+	if query.Interval > 0 {
+		return query.Interval
+	}
+	if query.MaxDataPoints > 0 {
+		return query.TimeRange.Duration() / time.Duration(query.MaxDataPoints)
+	}
+	return time.Minute
+}
+
+// formatInterval formats an interval in the largest whole unit, like Grafana does for $__interval
+func formatInterval(interval time.Duration) string {
+	units := []struct {
+		suffix   string
+		duration time.Duration
+	}{
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+	}
+
+	for _, unit := range units {
+		if interval >= unit.duration && interval%unit.duration == 0 {
+			return strconv.FormatInt(int64(interval/unit.duration), 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(int64(interval/time.Millisecond), 10) + "ms"
+}
+
+// parseInterval parses an interval like 30s, 5m or 1d. Days are accepted as they are used by Grafana intervals.
+func parseInterval(interval string) (time.Duration, error) {
+	if strings.HasSuffix(interval, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(interval, "d"))
+		if err == nil && days > 0 {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	}
+
+	duration, err := time.ParseDuration(interval)
+	if err != nil || duration <= 0 {
+		return 0, errors.New("the interval '" + interval + "' is not a duration like 30s, 5m or 1d")
+	}
+	return duration, nil
+}
+
+// interpolateQueryModel replaces the macros in the fields of a query, so a query gives the same results whether it
+// was sent by a panel or by an alert rule. A filter holding the All value matches everything. A filter that is only
+// a template variable was not replaced by the frontend, which happens when the query is sent by an alert rule. The
+// plugin can not know what it should match, so an error is returned rather than guessing.
+func interpolateQueryModel(qm *queryModel, query backend.DataQuery) error {
+	qm.SpaceName = interpolateMacros(qm.SpaceName, query)
+	qm.BucketInterval = interpolateMacros(qm.BucketInterval, query)
+
+	filters := []struct {
+		name   string
+		filter *string
+	}{
+		{"project", &qm.ProjectName},
+		{"environment", &qm.EnvironmentName},
+		{"channel", &qm.ChannelName},
+		{"tenant", &qm.TenantName},
+		{"release version", &qm.ReleaseVersion},
+		{"task state", &qm.TaskState},
+	}
+
+	for _, field := range filters {
+		value := interpolateMacros(*field.filter, query)
+
+		if value == allValue {
+			value = ""
+		} else if variableRegex.MatchString(value) {
+			return errors.New("the " + field.name + " filter " + value + " is a template variable that was not replaced. Use the All value of the variable to match every " + field.name)
+		}
+
+		*field.filter = value
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newMacroQuery returns a query over the first day of 2021, with a suggested interval of 5 minutes
+func newMacroQuery() backend.DataQuery {
+	query := backend.DataQuery{Interval: 5 * time.Minute}
+	query.TimeRange.From = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	query.TimeRange.To = time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC)
+	return query
+}
+
+func TestInterpolateMacros(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{"$__from", "1609459200000"},
+		{"${__to}", "1609545600000"},
+		{"$__interval", "5m"},
+		{"$__interval_ms", "300000"},
+		{"from $__from to $__to", "from 1609459200000 to 1609545600000"},
+		{"$__unknown", "$__unknown"},
+		{"$project", "$project"},
+		{"Web", "Web"},
+	}
+
+	for _, test := range tests {
+		if actual := interpolateMacros(test.text, newMacroQuery()); actual != test.expected {
+			t.Errorf("expected %s to be %s, got %s", test.text, test.expected, actual)
+		}
+	}
+}
+
+func TestIntervalFromMaxDataPoints(t *testing.T) {
+	query := newMacroQuery()
+	query.Interval = 0
+	query.MaxDataPoints = 24
+
+	if actual := interpolateMacros("$__interval", query); actual != "1h" {
+		t.Fatalf("expected the interval to fit the data points, got %s", actual)
+	}
+}
+
+func TestFormatAndParseInterval(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		text     string
+	}{
+		{48 * time.Hour, "2d"},
+		{90 * time.Minute, "90m"},
+		{30 * time.Second, "30s"},
+		{1500 * time.Millisecond, "1500ms"},
+	}
+
+	for _, test := range tests {
+		if actual := formatInterval(test.interval); actual != test.text {
+			t.Errorf("expected %s to be formatted as %s, got %s", test.interval, test.text, actual)
+		}
+
+		parsed, err := parseInterval(test.text)
+		if err != nil || parsed != test.interval {
+			t.Errorf("expected %s to be parsed as %s, got %s (%v)", test.text, test.interval, parsed, err)
+		}
+	}
+
+	for _, invalid := range []string{"hourly", "0s", "-5m", "d"} {
+		if _, err := parseInterval(invalid); err == nil {
+			t.Errorf("expected %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestInterpolateQueryModel(t *testing.T) {
+	qm := queryModel{
+		SpaceName:       "Default",
+		ProjectName:     allValue,
+		EnvironmentName: allValue,
+		ChannelName:     "{Default,Hotfix}",
+		TaskState:       "Success",
+		BucketInterval:  "$__interval",
+	}
+	err := interpolateQueryModel(&qm, newMacroQuery())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := queryModel{
+		SpaceName:      "Default",
+		ChannelName:    "{Default,Hotfix}",
+		TaskState:      "Success",
+		BucketInterval: "5m",
+	}
+	if !reflect.DeepEqual(qm, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, qm)
+	}
+}
+
+func TestInterpolateQueryModelVariables(t *testing.T) {
+	for _, variable := range []string{"$environment", "${environment}", "[[environment]]"} {
+		qm := queryModel{SpaceName: "Default", EnvironmentName: variable}
+		if err := interpolateQueryModel(&qm, newMacroQuery()); err == nil {
+			t.Errorf("expected the template variable %s to be an error", variable)
+		}
+	}
+}
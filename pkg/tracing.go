@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpgrpc"
+	"go.opentelemetry.io/otel/label"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// tracerName identifies the spans created by the plugin
+	tracerName = "github.com/OctopusDeploy/OctopusGrafanaDataSource"
+	// serviceName is the service the spans are reported against
+	serviceName = "octopus-grafana-datasource"
+	// otlpEndpointVariable is the environment variable holding the address of the OTLP collector, like localhost:4317
+	otlpEndpointVariable = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	// shutdownTimeout is how long the spans that have not been exported yet are given to reach the collector
+	shutdownTimeout = 5 * time.Second
+)
+
+func init() {
+	// Grafana sends the trace context in the W3C format, so the plugin spans join the trace of the Grafana request
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// initTracing exports spans to the OTLP collector named by the OTEL_EXPORTER_OTLP_ENDPOINT environment variable,
+// and returns a function that flushes the remaining spans when the plugin exits. Without a collector the spans
+// are not recorded at all.
+func initTracing() (func(), error) {
+	endpoint := os.Getenv(otlpEndpointVariable)
+	if empty(endpoint) {
+		return func() {}, nil
+	}
+
+	// the gRPC exporter expects a host and port rather than a URL
+	endpoint = strings.TrimPrefix(strings.TrimPrefix(endpoint, "http://"), "https://")
+
+	exporter, err := otlp.NewExporter(context.Background(), otlpgrpc.NewDriver(
+		otlpgrpc.WithInsecure(),
+		otlpgrpc.WithEndpoint(endpoint),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.ServiceNameKey.String(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	log.DefaultLogger.Info("Exporting traces to " + endpoint)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		err := provider.Shutdown(ctx)
+		if err != nil {
+			log.DefaultLogger.Error("Failed to export the remaining traces: " + err.Error())
+		}
+	}, nil
+}
+
+// startSpan starts a span that is a child of any span in ctx. The global tracer provider is looked up each time,
+// so the provider can be replaced after the plugin has started.
+func startSpan(ctx context.Context, name string, labels ...label.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(labels...))
+}
+
+// endSpan ends a span, marking it as failed if err is set
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// headerCarrier reads the trace context from the headers Grafana passes with a request. Header names are not
+// case sensitive, so they are matched ignoring case.
+type headerCarrier map[string]string
+
+func (c headerCarrier) Get(key string) string {
+	for name, value := range c {
+		if strings.EqualFold(name, key) {
+			return value
+		}
+	}
+	return ""
+}
+
+func (c headerCarrier) Set(key string, value string) {
+	c[key] = value
+}
+
+// extractTraceContext returns ctx with the trace context held in the headers of a Grafana request
+func extractTraceContext(ctx context.Context, headers map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, headerCarrier(headers))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/label"
+	"go.opentelemetry.io/otel/oteltest"
+	"go.opentelemetry.io/otel/trace"
+	"testing"
+)
+
+// recordSpans sends the spans started by the test to a recorder, until the returned function is called
+func recordSpans() (*oteltest.StandardSpanRecorder, func()) {
+	recorder := &oteltest.StandardSpanRecorder{}
+	otel.SetTracerProvider(oteltest.NewTracerProvider(oteltest.WithSpanRecorder(recorder)))
+	return recorder, func() {
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	}
+}
+
+func TestHeaderCarrierIgnoresCase(t *testing.T) {
+	carrier := headerCarrier{"Traceparent": "00-0102", "tracestate": "a=b"}
+
+	if value := carrier.Get("traceparent"); value != "00-0102" {
+		t.Errorf("expected the traceparent header, got %q", value)
+	}
+	if value := carrier.Get("TraceState"); value != "a=b" {
+		t.Errorf("expected the tracestate header, got %q", value)
+	}
+	if value := carrier.Get("baggage"); value != "" {
+		t.Errorf("expected no baggage header, got %q", value)
+	}
+}
+
+func TestQueryDataSpans(t *testing.T) {
+	server := newFakeOctopusServer(t)
+	defer server.Close()
+
+	recorder, stop := recordSpans()
+	defer stop()
+
+	traceId := "4bf92f3577b34da6a3ce929d0e0e4736"
+	parentId := "00f067aa0ba902b7"
+	req := newFakeQueryDataRequest(newFakePluginContext(server.URL, fakeApiKey), `{"format": "table", "spaceName": "Default", "projectName": "Web"}`)
+	req.Headers = map[string]string{"Traceparent": "00-" + traceId + "-" + parentId + "-01"}
+
+	_, err := newDatasource().QueryDataHandler.QueryData(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans := map[string][]*oteltest.Span{}
+	for _, span := range recorder.Completed() {
+		spans[span.Name()] = append(spans[span.Name()], span)
+
+		if span.SpanContext().TraceID.String() != traceId {
+			t.Errorf("expected the %s span to be part of the Grafana trace, got trace %s", span.Name(), span.SpanContext().TraceID)
+		}
+	}
+
+	for _, name := range []string{"QueryData", "prepareQueries", "getMaps", "createRequest", "createStreamingRequest", "buildFrame"} {
+		if len(spans[name]) == 0 {
+			t.Fatalf("expected a %s span", name)
+		}
+	}
+
+	if parent := spans["QueryData"][0].ParentSpanID().String(); parent != parentId {
+		t.Errorf("expected the QueryData span to be a child of the Grafana span, got %s", parent)
+	}
+
+	for _, span := range spans["createRequest"] {
+		if _, ok := span.Attributes()[label.Key("cache.hit")]; !ok {
+			t.Errorf("expected the request for %s to record whether the cache was hit", span.Attributes()[label.Key("http.url")].AsString())
+		}
+	}
+
+	if format := spans["buildFrame"][0].Attributes()[label.Key("format")].AsString(); format != "table" {
+		t.Errorf("expected the frame span to record the table format, got %s", format)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import "sync"
+
+// the number of requests a datasource can be waiting on Octopus for at once when it does not define one
+const defaultConcurrency = 4
+
+// workerPool runs functions concurrently, with no more than the pool size running at any one time
+type workerPool struct {
+	slots chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newWorkerPool(size int) *workerPool {
+	if size <= 0 {
+		size = defaultConcurrency
+	}
+
+	return &workerPool{
+		slots: make(chan struct{}, size),
+	}
+}
+
+// Go runs fn once a slot in the pool is free. Functions run by the pool must not add more work to the
+// same pool, as they would be waiting on themselves for a slot.
+func (p *workerPool) Go(fn func()) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.slots <- struct{}{}
+		defer func() { <-p.slots }()
+		fn()
+	}()
+}
+
+// Wait blocks until all the functions passed to Go have returned
+func (p *workerPool) Wait() {
+	p.wg.Wait()
+}
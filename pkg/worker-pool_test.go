@@ -0,0 +1,38 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolLimitsConcurrency(t *testing.T) {
+	pool := newWorkerPool(3)
+
+	var running, maxRunning, completed int32
+	for i := 0; i < 20; i++ {
+		pool.Go(func() {
+			current := atomic.AddInt32(&running, 1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if current <= max || atomic.CompareAndSwapInt32(&maxRunning, max, current) {
+					break
+				}
+			}
+
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			atomic.AddInt32(&completed, 1)
+		})
+	}
+
+	pool.Wait()
+
+	if completed != 20 {
+		t.Fatalf("expected 20 completed functions, got %d", completed)
+	}
+
+	if maxRunning > 3 {
+		t.Fatalf("expected at most 3 functions running at once, got %d", maxRunning)
+	}
+}
@@ -22,6 +22,8 @@ export class DataSource extends DataSourceWithBackend<MyQuery, MyDataSourceOptio
       channelName: query.channelName ? templateSrv.replace(query.channelName) : '',
       releaseVersion: query.releaseVersion ? templateSrv.replace(query.releaseVersion) : '',
       taskState: query.taskState ? templateSrv.replace(query.taskState) : '',
+      // the built-in macros like $__interval are left for the backend, which replaces them for alerting too
+      bucketInterval: query.bucketInterval ? templateSrv.replace(query.bucketInterval) : '',
     };
   }
 
@@ -97,23 +99,34 @@ export class DataSource extends DataSourceWithBackend<MyQuery, MyDataSourceOptio
       datasource
     );
     const projectId = await this.getEntityId(query.spaceName || '', 'projects', query.projectName || '', datasource);
-    const from = options.range.from.format('YYYY-MM-DD HH:mm:ss');
-    const to = options.range.to.format('YYYY-MM-DD HH:mm:ss');
+    const from = options.range.from.utc().format('YYYY-MM-DD HH:mm:ss');
+    const to = options.range.to.utc().format('YYYY-MM-DD HH:mm:ss');
 
     if (query.format === 'deployments') {
-      return this.getDeploymentAnnotation(datasourceId, spaceId, environmentId, projectId);
+      return this.getDeploymentAnnotation(datasourceId, spaceId, environmentId, projectId, from, to);
     } else {
       return this.getDeploymentReportAnnotation(datasourceId, spaceId, environmentId, projectId, from, to);
     }
   }
 
-  async getDeploymentAnnotation(datasourceId: string, spaceId: string, environmentId: string, projectId: string) {
+  async getDeploymentAnnotation(
+    datasourceId: string,
+    spaceId: string,
+    environmentId: string,
+    projectId: string,
+    from: string,
+    to: string
+  ) {
     const url =
       `api/datasources/${datasourceId}/resources/${spaceId}/deployments` +
       '?environmentId=' +
       encodeURI(environmentId) +
       '&projectId=' +
-      encodeURI(projectId);
+      encodeURI(projectId) +
+      '&fromCreated=' +
+      encodeURI(from) +
+      '&toCreated=' +
+      encodeURI(to);
 
     return fetch(url)
       .then(response => response.json())
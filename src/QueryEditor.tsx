@@ -8,6 +8,9 @@ import { defaultQuery, MyDataSourceOptions, MyQuery } from './types';
 
 const { FormField, Select } = LegacyForms;
 
+const filterTooltip =
+  'A name, a list of names like {Production,Staging}, or a regular expression like /^payments-/. Start with ! to exclude the matches, like !Cancelled.';
+
 type Props = QueryEditorProps<DataSource, MyQuery, MyDataSourceOptions>;
 
 export class QueryEditor extends PureComponent<Props> {
@@ -51,6 +54,11 @@ export class QueryEditor extends PureComponent<Props> {
     onChange({ ...query, taskState: event.target.value });
   };
 
+  onBucketIntervalTextChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const { onChange, query } = this.props;
+    onChange({ ...query, bucketInterval: event.target.value });
+  };
+
   onSuccessFieldSwitchChange = (event: ChangeEvent<HTMLInputElement>) => {
     const { onChange, query } = this.props;
     onChange({ ...query, successField: event.target.checked });
@@ -111,6 +119,7 @@ export class QueryEditor extends PureComponent<Props> {
       tenantName,
       releaseVersion,
       taskState,
+      bucketInterval,
       format,
       successField,
       failureField,
@@ -180,39 +189,53 @@ export class QueryEditor extends PureComponent<Props> {
               value={projectName || ''}
               onChange={this.onProjectNameTextChange}
               label="Project Name Filter"
+              tooltip={filterTooltip}
             />
             <FormField
               labelWidth={20}
               value={environmentName || ''}
               onChange={this.onEnvironmentNameTextChange}
               label="Environment Name Filter"
+              tooltip={filterTooltip}
             />
             <FormField
               labelWidth={20}
               value={channelName || ''}
               onChange={this.onChannelNameTextChange}
               label="Channel Name Filter"
+              tooltip={filterTooltip}
             />
             <FormField
               labelWidth={20}
               value={tenantName || ''}
               onChange={this.onTenantNameTextChange}
               label="Tenant Name Filter"
+              tooltip={filterTooltip}
             />
             <FormField
               labelWidth={20}
               value={releaseVersion || ''}
               onChange={this.onReleaseVersionTextChange}
               label="Release Version Filter"
+              tooltip={filterTooltip}
             />
             <FormField
               labelWidth={20}
               value={taskState || ''}
               onChange={this.onTaskSTateTextChange}
               label="Task State Filter"
+              tooltip={filterTooltip}
             />
             {format === 'timeseries' && (
               <div>
+                <FormField
+                  labelWidth={20}
+                  value={bucketInterval || ''}
+                  onChange={this.onBucketIntervalTextChange}
+                  label="Bucket Interval"
+                  placeholder="Auto"
+                  tooltip="The duration of each bucket, like 1h or $__interval. The buckets fit the panel when left blank."
+                />
                 <div style={{ alignContent: 'flex-start', flexWrap: 'wrap', display: 'flex', flexDirection: 'row' }}>
                   <InlineFormLabel width={20}>Return Success Field</InlineFormLabel>
                   <Switch
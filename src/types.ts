@@ -9,6 +9,7 @@ export interface MyQuery extends DataQuery {
   releaseVersion?: string;
   taskState?: string;
   format?: string;
+  bucketInterval?: string;
   successField: boolean;
   failureField: boolean;
   timedOutField: boolean;
@@ -38,6 +39,18 @@ export const defaultQuery: Partial<MyQuery> = {
 export interface MyDataSourceOptions extends DataSourceJsonData {
   server?: string;
   cacheDuration?: string;
+  cacheSize?: number;
+  persistentCache?: boolean;
+  persistentCacheDirectory?: string;
+  timeout?: string;
+  concurrency?: number;
+  rateLimit?: number;
+  rateLimitBurst?: number;
+  logResponseBodies?: boolean;
+  tlsSkipVerify?: boolean;
+  tlsAuth?: boolean;
+  tlsAuthWithCACert?: boolean;
+  httpHeaderName1?: string;
 }
 
 /**
@@ -45,4 +58,8 @@ export interface MyDataSourceOptions extends DataSourceJsonData {
  */
 export interface MySecureJsonData {
   apiKey?: string;
+  tlsCACert?: string;
+  tlsClientCert?: string;
+  tlsClientKey?: string;
+  httpHeaderValue1?: string;
 }